@@ -0,0 +1,106 @@
+// gh-deployer - A simple server that listens for changes on GitHub and deploys projects.
+// Copyright (C) 2017 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+
+	"golang.org/x/crypto/ssh/knownhosts"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/ssh"
+)
+
+// getAuth gets the credentials to use when cloning or pulling the given repository.
+// If the repository has no credentials configured, nil is returned.
+func getAuth(owner, repo string) (transport.AuthMethod, error) {
+	repoConf, _ := config.GetRepository(owner, repo)
+	if len(repoConf.SSHKey) > 0 {
+		return repoConf.sshAuth(config.GetCloneURL(owner, repo))
+	} else if len(repoConf.HTTPTokenFile) > 0 || len(repoConf.HTTPTokenEnv) > 0 {
+		return repoConf.httpAuth()
+	}
+	return nil, nil
+}
+
+func (repoConf RepositoryConfig) httpAuth() (transport.AuthMethod, error) {
+	var token string
+	if len(repoConf.HTTPTokenFile) > 0 {
+		data, err := ioutil.ReadFile(repoConf.HTTPTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read HTTP token: %v", err)
+		}
+		token = strings.TrimSpace(string(data))
+	} else {
+		token = os.Getenv(repoConf.HTTPTokenEnv)
+	}
+	if len(token) == 0 {
+		return nil, fmt.Errorf("HTTP token is empty")
+	}
+
+	username := repoConf.HTTPUsername
+	if len(username) == 0 {
+		username = "x-access-token"
+	}
+	return &http.BasicAuth{Username: username, Password: token}, nil
+}
+
+var urlCredentials = regexp.MustCompile(`://[^/@\s]+@`)
+
+// redact removes credentials from the given error so that it can be logged safely.
+func redact(err error, auth transport.AuthMethod) string {
+	str := err.Error()
+	if basicAuth, ok := auth.(*http.BasicAuth); ok && len(basicAuth.Password) > 0 {
+		str = strings.Replace(str, basicAuth.Password, "<redacted>", -1)
+	}
+	return urlCredentials.ReplaceAllString(str, "://<redacted>@")
+}
+
+func (repoConf RepositoryConfig) sshAuth(url string) (transport.AuthMethod, error) {
+	user := "git"
+	if endpoint, err := transport.NewEndpoint(url); err == nil && len(endpoint.User) > 0 {
+		user = endpoint.User
+	}
+
+	var passphrase string
+	if len(repoConf.SSHKeyPassphraseFile) > 0 {
+		data, err := ioutil.ReadFile(repoConf.SSHKeyPassphraseFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read SSH key passphrase: %v", err)
+		}
+		passphrase = strings.TrimRight(string(data), "\r\n")
+	}
+
+	auth, err := ssh.NewPublicKeysFromFile(user, repoConf.SSHKey, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load SSH key %s: %v", repoConf.SSHKey, err)
+	}
+
+	// If no known_hosts file is specified, go-git uses the default files
+	// (~/.ssh/known_hosts and /etc/ssh/ssh_known_hosts).
+	if len(repoConf.KnownHosts) > 0 {
+		auth.HostKeyCallback, err = knownhosts.New(repoConf.KnownHosts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load known hosts from %s: %v", repoConf.KnownHosts, err)
+		}
+	}
+	return auth, nil
+}
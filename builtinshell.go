@@ -0,0 +1,90 @@
+// gh-deployer - A simple server that listens for changes on GitHub and deploys projects.
+// Copyright (C) 2017 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"mvdan.cc/sh/expand"
+	"mvdan.cc/sh/interp"
+	"mvdan.cc/sh/syntax"
+)
+
+// BuiltinShell is the shell name that makes commands run in the POSIX shell
+// interpreter embedded in gh-deployer instead of an external shell binary.
+const BuiltinShell = "builtin"
+
+// builtinShellArg is the first argument that makes gh-deployer run a script
+// with the builtin shell instead of starting the server. The builtin shell is
+// run in a separate gh-deployer process, so that scripts run as the same user
+// and in the same process group as they would in any other shell.
+const builtinShellArg = "__builtin-shell"
+
+// builtinShellCommand returns the program and arguments to run scripts in the builtin shell with.
+func builtinShellCommand() (string, []string) {
+	executable, err := os.Executable()
+	if err != nil {
+		executable = os.Args[0]
+	}
+	return executable, []string{builtinShellArg}
+}
+
+// parseScript parses a command as a shell script. The bash dialect is used as
+// it's a superset of POSIX sh and the interpreter doesn't support the export
+// and readonly builtins in strict POSIX mode.
+func parseScript(script string) (*syntax.File, error) {
+	return syntax.NewParser().Parse(strings.NewReader(script), "")
+}
+
+// runBuiltinShell interprets a script in the current process with the current
+// working directory and environment, and returns the exit status of the script.
+// If the script can't be parsed, the status is exitSetupFailed.
+func runBuiltinShell(script string) int {
+	file, err := parseScript(script)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gh-deployer:", err)
+		return exitSetupFailed
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gh-deployer:", err)
+		return exitSetupFailed
+	}
+	runner, err := interp.New(
+		interp.Dir(dir),
+		interp.Env(expand.ListEnviron(os.Environ()...)),
+		interp.StdIO(os.Stdin, os.Stdout, os.Stderr))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gh-deployer:", err)
+		return exitSetupFailed
+	}
+	err = runner.Run(context.Background(), file)
+	switch status := err.(type) {
+	case nil:
+		return 0
+	case interp.ExitStatus:
+		return int(status)
+	case interp.ShellExitStatus:
+		return int(status)
+	default:
+		fmt.Fprintln(os.Stderr, "gh-deployer:", err)
+		return 1
+	}
+}
@@ -19,20 +19,186 @@ package main
 import (
 	"io/ioutil"
 	"os"
+	"path"
+	"strconv"
 	"strings"
+	"time"
 
 	yaml "gopkg.in/yaml.v2"
 
+	"maunium.net/go/githuuk"
 	log "maunium.net/go/maulogger"
 )
 
 // Config is the main global config struct.
 type Config struct {
-	Host          string `yaml:"host"`
-	Port          uint16 `yaml:"port"`
-	Path          string `yaml:"path"`
-	Secret        string `yaml:"secret"`
-	PullDirectory string `yaml:"pull-directory"`
+	Host             string   `yaml:"host"`
+	Port             uint16   `yaml:"port"`
+	Path             string   `yaml:"path"`
+	Secret           string   `yaml:"secret"`
+	Secrets          []string `yaml:"secrets"`
+	RequireSHA256    bool     `yaml:"require-sha256"`
+	PullDirectory    string   `yaml:"pull-directory"`
+	TagDirectory     string   `yaml:"tag-directory"`
+	PreviewDirectory string   `yaml:"preview-directory"`
+	CloneURL         string   `yaml:"clone-url"`
+	Workers          int      `yaml:"workers"`
+
+	CancelInProgress bool `yaml:"cancel-in-progress"`
+	ForceRemove      bool `yaml:"force-remove"`
+
+	MaxDeployTimeout time.Duration `yaml:"max-deploy-timeout"`
+	KillGracePeriod  time.Duration `yaml:"kill-grace-period"`
+
+	Environment EnvironmentPolicy `yaml:"environment"`
+	RunAs       RunAs             `yaml:"run-as"`
+	Sandbox     SandboxPolicy     `yaml:"sandbox"`
+
+	Repositories map[string]RepositoryConfig `yaml:"repositories"`
+}
+
+// RepositoryConfig contains the settings for a single allowed repository.
+type RepositoryConfig struct {
+	CloneURL string   `yaml:"clone-url"`
+	Secret   string   `yaml:"secret"`
+	Secrets  []string `yaml:"secrets"`
+	Branches []string `yaml:"branches"`
+	Tags     []string `yaml:"tags"`
+	Previews bool     `yaml:"previews"`
+
+	ProtectedBranches []string `yaml:"protected-branches"`
+
+	SSHKey               string `yaml:"ssh-key"`
+	SSHKeyPassphraseFile string `yaml:"ssh-key-passphrase-file"`
+	KnownHosts           string `yaml:"known-hosts"`
+
+	HTTPUsername  string `yaml:"http-username"`
+	HTTPTokenFile string `yaml:"http-token-file"`
+	HTTPTokenEnv  string `yaml:"http-token-env"`
+
+	Environment EnvironmentPolicy `yaml:"environment"`
+	RunAs       RunAs             `yaml:"run-as"`
+	Sandbox     SandboxPolicy     `yaml:"sandbox"`
+
+	DeploySecrets               []DeploySecret `yaml:"deploy-secrets"`
+	DeploySecretsFile           string         `yaml:"deploy-secrets-file"`
+	DeploySecretsPassphraseFile string         `yaml:"deploy-secrets-passphrase-file"`
+}
+
+// EnvironmentPolicy controls which environment variables deployment commands get.
+type EnvironmentPolicy struct {
+	// Variables (KEY=value) to set for all commands.
+	Base []string `yaml:"base"`
+	// Globs of the names of variables to copy from the environment of the deployer.
+	PassThrough []string `yaml:"pass-through"`
+}
+
+// defaultPassThrough is the list of variables copied from the environment of
+// the deployer if pass-through isn't set in the config.
+var defaultPassThrough = []string{"PATH", "HOME", "USER", "LOGNAME", "LANG", "LC_*", "TZ", "TMPDIR"}
+
+// GetEnvironment gets the base environment for the deployment commands of a
+// repository. Variables set in the repository config override the global ones.
+func (config Config) GetEnvironment(owner, repo string) []string {
+	repoConf, _ := config.GetRepository(owner, repo)
+	passThrough := config.Environment.PassThrough
+	if passThrough == nil {
+		passThrough = defaultPassThrough
+	}
+	passThrough = append(append([]string{}, passThrough...), repoConf.Environment.PassThrough...)
+
+	var env []string
+	for _, pair := range os.Environ() {
+		if matchAny(passThrough, strings.SplitN(pair, "=", 2)[0]) {
+			env = append(env, pair)
+		}
+	}
+	env = append(env, config.Environment.Base...)
+	return append(env, repoConf.Environment.Base...)
+}
+
+// GetRepository gets the config of a repository and whether or not the repository is allowed.
+func (config Config) GetRepository(owner, repo string) (RepositoryConfig, bool) {
+	return config.getRepository(owner + "/" + repo)
+}
+
+func (config Config) getRepository(fullName string) (RepositoryConfig, bool) {
+	if config.Repositories == nil {
+		return RepositoryConfig{}, true
+	}
+	repoConf, ok := config.Repositories[strings.ToLower(fullName)]
+	return repoConf, ok
+}
+
+// GetSecrets gets the webhook secrets accepted for the repository with the given full name.
+// Repositories without their own secrets use the global secrets.
+func (config Config) GetSecrets(fullName string) []string {
+	repoConf, _ := config.getRepository(fullName)
+	if secrets := collectSecrets(repoConf.Secret, repoConf.Secrets); len(secrets) > 0 {
+		return secrets
+	}
+	return collectSecrets(config.Secret, config.Secrets)
+}
+
+func collectSecrets(secret string, secrets []string) []string {
+	if len(secret) > 0 {
+		return append([]string{secret}, secrets...)
+	}
+	return secrets
+}
+
+// IsAllowed checks if the given branch or tag of the given repository may be deployed.
+func (config Config) IsAllowed(owner, repo string, ref githuuk.Reference) bool {
+	if config.Repositories == nil {
+		return true
+	}
+	repoConf, ok := config.GetRepository(owner, repo)
+	if !ok {
+		return false
+	} else if ref.IsTag() {
+		return repoConf.MatchTag(ref.Name())
+	}
+	return repoConf.MatchBranch(ref.Name())
+}
+
+// IsProtected checks if force pushes to the given branch of the given repository should be refused.
+func (config Config) IsProtected(owner, repo string, ref githuuk.Reference) bool {
+	repoConf, _ := config.GetRepository(owner, repo)
+	return ref.IsBranch() && matchAny(repoConf.ProtectedBranches, ref.Name())
+}
+
+// IsPreviewAllowed checks if pull requests of the given repository may be deployed as previews.
+// Previews must always be enabled separately for each repository.
+func (config Config) IsPreviewAllowed(owner, repo string) bool {
+	if len(config.PreviewDirectory) == 0 {
+		return false
+	}
+	repoConf, _ := config.GetRepository(owner, repo)
+	return repoConf.Previews
+}
+
+// MatchBranch checks if the given branch matches any of the branch globs of this repository.
+// If no branch globs are configured, all branches match.
+func (repoConf RepositoryConfig) MatchBranch(branch string) bool {
+	if len(repoConf.Branches) == 0 {
+		return true
+	}
+	return matchAny(repoConf.Branches, branch)
+}
+
+// MatchTag checks if the given tag matches any of the tag globs of this repository.
+// If no tag globs are configured, no tags match.
+func (repoConf RepositoryConfig) MatchTag(tag string) bool {
+	return matchAny(repoConf.Tags, tag)
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if match, _ := path.Match(pattern, name); match {
+			return true
+		}
+	}
+	return false
 }
 
 // GetPath gets the path to a pull directory
@@ -43,6 +209,37 @@ func (config Config) GetPath(owner, repo, branch string) (str string) {
 	return
 }
 
+// GetCloneURL gets the URL to clone the given repository from.
+func (config Config) GetCloneURL(owner, repo string) (str string) {
+	str = config.CloneURL
+	if repoConf, _ := config.GetRepository(owner, repo); len(repoConf.CloneURL) > 0 {
+		str = repoConf.CloneURL
+	}
+	str = strings.Replace(str, "$REPO_NAME", repo, -1)
+	str = strings.Replace(str, "$REPO_OWNER", owner, -1)
+	return
+}
+
+// GetPreviewPath gets the path to a pull request preview directory.
+func (config Config) GetPreviewPath(owner, repo string, number int) (str string) {
+	str = strings.Replace(config.PreviewDirectory, "$REPO_NAME", repo, -1)
+	str = strings.Replace(str, "$REPO_OWNER", owner, -1)
+	str = strings.Replace(str, "$PR_NUMBER", strconv.Itoa(number), -1)
+	return
+}
+
+// GetTagPath gets the path to a tag directory.
+// If no tag directory is configured, tags are placed in the pull directory like branches.
+func (config Config) GetTagPath(owner, repo, tag string) (str string) {
+	if len(config.TagDirectory) == 0 {
+		return strings.Replace(config.GetPath(owner, repo, tag), "$TAG", tag, -1)
+	}
+	str = strings.Replace(config.TagDirectory, "$REPO_NAME", repo, -1)
+	str = strings.Replace(str, "$REPO_OWNER", owner, -1)
+	str = strings.Replace(str, "$TAG", tag, -1)
+	return
+}
+
 func openConfig() {
 	log.Debugln("Opening config from", *configPath)
 	data, err := ioutil.ReadFile(*configPath)
@@ -55,4 +252,22 @@ func openConfig() {
 		log.Fatalln("Failed to parse config:", err)
 		os.Exit(3)
 	}
+	if len(config.CloneURL) == 0 {
+		config.CloneURL = "https://github.com/$REPO_OWNER/$REPO_NAME.git"
+	}
+	if config.KillGracePeriod <= 0 {
+		config.KillGracePeriod = 10 * time.Second
+	}
+	if config.Workers <= 0 {
+		config.Workers = 1
+	}
+	if config.Repositories == nil {
+		log.Warnln("No repositories configured, all repositories and branches will be deployed.")
+	} else {
+		repos := make(map[string]RepositoryConfig, len(config.Repositories))
+		for name, repoConf := range config.Repositories {
+			repos[strings.ToLower(name)] = repoConf
+		}
+		config.Repositories = repos
+	}
 }
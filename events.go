@@ -0,0 +1,89 @@
+// gh-deployer - A simple server that listens for changes on GitHub and deploys projects.
+// Copyright (C) 2017 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"maunium.net/go/githuuk"
+)
+
+// PushEvent is a push event with the fields githuuk doesn't parse.
+type PushEvent struct {
+	githuuk.PushEvent
+	Before string `json:"before"`
+	After  string `json:"after"`
+	Pusher Pusher `json:"pusher"`
+}
+
+// Pusher is the user who pushed in a push event. Unlike other users in events,
+// the pusher only has a name and an email.
+type Pusher struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+// PullRequestEvent is a pull request event with the fields githuuk doesn't parse.
+type PullRequestEvent struct {
+	githuuk.PullRequestEvent
+	PullRequest PullRequest `json:"pull_request"`
+	// The previous and new head commits in synchronize events.
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+// PullRequest contains the metadata of a pull request.
+type PullRequest struct {
+	githuuk.PullRequest
+	Merged bool           `json:"merged"`
+	Head   PullRequestRef `json:"head"`
+	Base   PullRequestRef `json:"base"`
+}
+
+// PullRequestRef is the head or base of a pull request.
+type PullRequestRef struct {
+	Label string `json:"label"`
+	Ref   string `json:"ref"`
+	SHA   string `json:"sha"`
+}
+
+// Ref returns the reference GitHub exposes the head of the pull request as in the base repository.
+func (pr PullRequest) Ref() githuuk.Reference {
+	return githuuk.Reference(fmt.Sprintf("refs/pull/%d/head", pr.Number))
+}
+
+// ParseEvent parses a JSON body into an event struct of the given type.
+// Push and pull request events are parsed into the local event types,
+// everything else is parsed by githuuk.
+func (server *WebhookServer) ParseEvent(eventType githuuk.EventType, body []byte) (githuuk.Event, int, error) {
+	var evt githuuk.Event
+	switch eventType {
+	case githuuk.EventPush:
+		evt = &PushEvent{PushEvent: githuuk.PushEvent{BaseEvent: githuuk.BaseEvent{Type: eventType}}}
+	case githuuk.EventPullRequest:
+		evt = &PullRequestEvent{PullRequestEvent: githuuk.PullRequestEvent{BaseEvent: githuuk.BaseEvent{Type: eventType}}}
+	default:
+		return server.Server.ParseEvent(eventType, body)
+	}
+	err := json.Unmarshal(body, evt)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	return evt, http.StatusOK, nil
+}
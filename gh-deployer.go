@@ -32,6 +32,12 @@ var wantHelp, _ = flag.MakeHelpFlag()
 var config = Config{}
 
 func main() {
+	if len(os.Args) == 3 && os.Args[1] == builtinShellArg {
+		os.Exit(runBuiltinShell(os.Args[2]))
+	} else if len(os.Args) > 4 && os.Args[1] == sandboxArg {
+		os.Exit(runSandbox(os.Args[2], os.Args[3], os.Args[4:]))
+	}
+
 	flag.SetHelpTitles(
 		"gh-deployer 0.1 - A simple server that listens for changes on GitHub and deploys projects.",
 		"gh-deployer [-h] [-c /path/to/config]")
@@ -19,30 +19,214 @@ package main
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 
+	"gopkg.in/src-d/go-billy.v4/osfs"
 	git "gopkg.in/src-d/go-git.v4"
+	gitconfig "gopkg.in/src-d/go-git.v4/config"
 	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	"gopkg.in/src-d/go-git.v4/storage/filesystem"
+	"maunium.net/go/githuuk"
 	log "maunium.net/go/maulogger"
 )
 
-func clone(owner, repo, branch string) {
-	log.Debugf("Cloning %s/%s branch %s\n", owner, repo, branch)
-	r, err := git.PlainClone(config.GetPath(owner, repo, branch), false, &git.CloneOptions{
-		URL:           fmt.Sprintf("https://github.com/%s/%s.git", owner, repo),
-		ReferenceName: plumbing.ReferenceName(fmt.Sprintf("refs/heads/%s", branch)),
+// openStorage opens the git directory of a workspace.
+func openStorage(dir string) (*filesystem.Storage, error) {
+	return filesystem.NewStorage(osfs.New(filepath.Join(dir, git.GitDirName)))
+}
+
+// openRepository opens the repository in a workspace. The worktree is
+// accessed through newWorktreeFS, as it may be owned by the run-as user.
+func openRepository(dir string) (*git.Repository, error) {
+	storage, err := openStorage(dir)
+	if err != nil {
+		return nil, err
+	}
+	return git.Open(storage, newWorktreeFS(dir))
+}
+
+func clone(job *Job, auth transport.AuthMethod) (*git.Repository, error) {
+	log.Debugln("Cloning", job)
+	opts := &git.CloneOptions{
+		URL:  config.GetCloneURL(job.Owner, job.Repo),
+		Auth: auth,
+	}
+	if job.Ref.IsBranch() {
+		opts.ReferenceName = plumbing.ReferenceName(job.Ref)
+	} else {
+		opts.NoCheckout = true
+	}
+	storage, err := openStorage(job.Directory())
+	if err != nil {
+		return nil, err
+	}
+	r, err := git.Clone(storage, newWorktreeFS(job.Directory()), opts)
+	if err != nil {
+		return nil, err
+	}
+	if !job.Ref.IsBranch() {
+		err = fetchDetached(r, job.Ref, auth)
+	}
+	return r, err
+}
+
+// peelCommit returns the hash of the commit the given hash points to.
+// Annotated tags point to a tag object rather than directly to a commit.
+func peelCommit(r *git.Repository, hash plumbing.Hash) (plumbing.Hash, error) {
+	tagObject, err := r.TagObject(hash)
+	if err != nil {
+		return hash, nil
+	}
+	commit, err := tagObject.Commit()
+	if err != nil {
+		return hash, err
+	}
+	return commit.Hash, nil
+}
+
+// fetchDetached fetches a non-branch reference (a tag or a pull request head)
+// and checks out the commit it points to.
+func fetchDetached(r *git.Repository, ref githuuk.Reference, auth transport.AuthMethod) error {
+	err := r.Fetch(&git.FetchOptions{
+		RefSpecs: []gitconfig.RefSpec{gitconfig.RefSpec(fmt.Sprintf("+%[1]s:%[1]s", ref))},
+		Auth:     auth,
 	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return err
+	}
+	resolved, err := r.Reference(plumbing.ReferenceName(ref), true)
+	if err != nil {
+		return err
+	}
+	hash, err := peelCommit(r, resolved.Hash())
+	if err != nil {
+		return err
+	}
+	w, err := r.Worktree()
+	if err != nil {
+		return err
+	}
+	return w.Checkout(&git.CheckoutOptions{Hash: hash, Force: true})
+}
+
+// isReachable checks if the target commit is reachable from the tip commit.
+func isReachable(r *git.Repository, tip, target plumbing.Hash) (bool, error) {
+	iter, err := r.Log(&git.LogOptions{From: tip})
 	if err != nil {
-		log.Debugf("Failed to clone %s/%s branch %s: %s\n", owner, repo, branch, err)
-		return
+		return false, err
 	}
-	w, _ := r.Worktree()
-	w.Pull(&git.PullOptions{
-		ReferenceName: plumbing.ReferenceName(fmt.Sprintf("refs/heads/%s", branch)),
+	found := false
+	err = iter.ForEach(func(commit *object.Commit) error {
+		if commit.Hash == target {
+			found = true
+			return storer.ErrStop
+		}
+		return nil
 	})
+	return found, err
 }
 
-func remove(owner, repo, branch string) {
-	path := config.GetPath(owner, repo, branch)
+// checkoutCommit checks out the exact commit the job was created for after
+// making sure that the commit is reachable from the fetched branch or ref.
+func checkoutCommit(r *git.Repository, job *Job) error {
+	tipName := plumbing.ReferenceName(job.Ref)
+	if job.Ref.IsBranch() {
+		tipName = plumbing.ReferenceName(fmt.Sprintf("refs/remotes/%s/%s", git.DefaultRemoteName, job.Ref.Name()))
+	}
+	tipRef, err := r.Reference(tipName, true)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %v", tipName, err)
+	}
+	tip, err := peelCommit(r, tipRef.Hash())
+	if err != nil {
+		return err
+	}
+	target, err := peelCommit(r, plumbing.NewHash(job.Commit))
+	if err != nil {
+		return err
+	}
+	if tip != target {
+		reachable, err := isReachable(r, tip, target)
+		if err != nil {
+			return fmt.Errorf("failed to check if %s is reachable from %s: %v", job.Commit, tipName, err)
+		} else if !reachable {
+			return fmt.Errorf("commit %s is not reachable from %s", job.Commit, tipName)
+		}
+	}
+
+	w, err := r.Worktree()
+	if err != nil {
+		return err
+	}
+	if job.Ref.IsBranch() {
+		return w.Reset(&git.ResetOptions{Commit: target, Mode: git.HardReset})
+	}
+	return w.Checkout(&git.CheckoutOptions{Hash: target, Force: true})
+}
+
+// go-git doesn't have an error variable for failed fast-forwards.
+const errNonFastForward = "non-fast-forward update"
+
+// pullBranch fast-forwards the current branch to the remote branch. If the
+// branch was force-pushed, the workspace is hard-reset to the remote branch
+// instead, unless the branch is protected.
+func pullBranch(r *git.Repository, job *Job, auth transport.AuthMethod) error {
+	w, err := r.Worktree()
+	if err != nil {
+		return err
+	}
+	if !job.Forced {
+		err = w.Pull(&git.PullOptions{
+			ReferenceName: plumbing.ReferenceName(job.Ref),
+			Auth:          auth,
+		})
+		if err == nil || err == git.NoErrAlreadyUpToDate || err.Error() != errNonFastForward {
+			return err
+		} else if config.IsProtected(job.Owner, job.Repo, job.Ref) {
+			return fmt.Errorf("refusing to deploy non-fast-forward update to protected branch")
+		}
+	}
+	log.Warnf("%s was force-pushed, resetting workspace to remote branch\n", job)
+
+	err = r.Fetch(&git.FetchOptions{Auth: auth, Force: true})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return err
+	}
+	remoteName := plumbing.ReferenceName(fmt.Sprintf("refs/remotes/%s/%s", git.DefaultRemoteName, job.Ref.Name()))
+	remoteRef, err := r.Reference(remoteName, true)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %v", remoteName, err)
+	}
+	return w.Reset(&git.ResetOptions{Commit: remoteRef.Hash(), Mode: git.HardReset})
+}
+
+// updateRemoteURL makes sure the origin remote points to the given URL, so
+// that changing the clone URL in the config applies to existing checkouts.
+func updateRemoteURL(r *git.Repository, url string) error {
+	remote, err := r.Remote(git.DefaultRemoteName)
+	if err == nil {
+		if urls := remote.Config().URLs; len(urls) == 1 && urls[0] == url {
+			return nil
+		}
+		err = r.DeleteRemote(git.DefaultRemoteName)
+		if err != nil {
+			return err
+		}
+	} else if err != git.ErrRemoteNotFound {
+		return err
+	}
+	_, err = r.CreateRemote(&gitconfig.RemoteConfig{
+		Name: git.DefaultRemoteName,
+		URLs: []string{url},
+	})
+	return err
+}
+
+func remove(job *Job) {
+	path := job.Directory()
 	log.Debugln("Removing", path)
 	err := os.RemoveAll(path)
 	if err != nil {
@@ -50,25 +234,48 @@ func remove(owner, repo, branch string) {
 	}
 }
 
-func pull(owner, repo, branch string) {
-	log.Debugf("Pulling %s/%s branch %s\n", owner, repo, branch)
-	path := config.GetPath(owner, repo, branch)
+// pull clones or updates the directory of the job and checks out the commit
+// the job was created for.
+func pull(job *Job) error {
+	log.Debugln("Pulling", job)
+	if job.Forced && config.IsProtected(job.Owner, job.Repo, job.Ref) {
+		return fmt.Errorf("refusing to deploy force push to protected branch")
+	}
+	auth, err := getAuth(job.Owner, job.Repo)
+	if err != nil {
+		return fmt.Errorf("failed to get credentials: %v", err)
+	}
+
+	path := job.Directory()
 	if _, err := os.Stat(path); os.IsNotExist(err) {
 		os.MkdirAll(path, 0755)
 	}
-	r, err := git.PlainOpen(path)
+	r, err := openRepository(path)
 	if err != nil {
 		// Shouldn't be a critical error, just debug
 		log.Debugf("Failed to open repo at %s: %s\n", path, err)
-		remove(owner, repo, branch)
-		clone(owner, repo, branch)
-		return
+		remove(job)
+		r, err = clone(job, auth)
+		if err != nil {
+			return fmt.Errorf("failed to clone: %s", redact(err, auth))
+		}
+	} else {
+		err = updateRemoteURL(r, config.GetCloneURL(job.Owner, job.Repo))
+		if err != nil {
+			return fmt.Errorf("failed to update remote URL: %s", redact(err, nil))
+		}
+		if job.Ref.IsBranch() {
+			err = pullBranch(r, job, auth)
+		} else {
+			err = fetchDetached(r, job.Ref, auth)
+		}
+		if err != nil && err != git.NoErrAlreadyUpToDate {
+			return fmt.Errorf("failed to pull: %s", redact(err, auth))
+		}
 	}
-	w, _ := r.Worktree()
-	err = w.Pull(&git.PullOptions{
-		ReferenceName: plumbing.ReferenceName(fmt.Sprintf("refs/heads/%s", branch)),
-	})
-	if err != nil {
-		log.Errorf("Failed to pull repo at %s: %s\n", path, err)
+
+	if len(job.Commit) > 0 {
+		return checkoutCommit(r, job)
 	}
+	return nil
 }
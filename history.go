@@ -0,0 +1,86 @@
+// gh-deployer - A simple server that listens for changes on GitHub and deploys projects.
+// Copyright (C) 2017 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"path/filepath"
+	"time"
+
+	"maunium.net/go/githuuk"
+)
+
+// historyLength is the number of deployments kept in the history of a workspace.
+const historyLength = 50
+
+// historyPath returns the path to the deployment history file of a workspace.
+// The history is stored inside the .git directory, as go-git removes
+// untracked files from the working tree when updating it.
+func historyPath(dir string) string {
+	return filepath.Join(dir, ".git", "gh-deployer-history.json")
+}
+
+// DeploymentRecord is an entry in the deployment history of a workspace.
+type DeploymentRecord struct {
+	ID         string            `json:"id"`
+	Commit     string            `json:"commit"`
+	Status     DeployStatus      `json:"status"`
+	EventType  githuuk.EventType `json:"event_type,omitempty"`
+	Sender     string            `json:"sender,omitempty"`
+	StartedAt  time.Time         `json:"started_at"`
+	FinishedAt time.Time         `json:"finished_at"`
+}
+
+// newDeployID generates a random ID for a deployment.
+func newDeployID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// readHistory reads the deployment history of a workspace, oldest deployment first.
+func readHistory(dir string) (history []DeploymentRecord) {
+	dat, err := readStateFile(historyPath(dir))
+	if err == nil {
+		json.Unmarshal(dat, &history)
+	}
+	return
+}
+
+// addHistory adds a deployment to the history of a workspace, dropping the
+// oldest entries if the history is full.
+func addHistory(dir string, record DeploymentRecord) error {
+	history := append(readHistory(dir), record)
+	if len(history) > historyLength {
+		history = history[len(history)-historyLength:]
+	}
+	dat, _ := json.MarshalIndent(history, "", "  ")
+	return writeStateFile(historyPath(dir), dat, 0644)
+}
+
+// lastDeployedCommit finds the commit of the latest successful deployment in the workspace.
+func lastDeployedCommit(dir string) string {
+	history := readHistory(dir)
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Status == StatusSucceeded {
+			return history[i].Commit
+		}
+	}
+	return ""
+}
@@ -0,0 +1,196 @@
+// gh-deployer - A simple server that listens for changes on GitHub and deploys projects.
+// Copyright (C) 2017 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// RunnerJob is a named list of steps in a deployment. Jobs run concurrently
+// unless they need other jobs to finish first.
+type RunnerJob struct {
+	Needs       []string `yaml:"needs"`
+	Environment []string `yaml:"env"`
+	Steps       []Step   `yaml:"steps"`
+}
+
+// validateJobs checks that all the jobs needed by other jobs exist and that
+// there are no dependency cycles.
+func validateJobs(jobs map[string]*RunnerJob) error {
+	const (
+		visiting = iota + 1
+		visited
+	)
+	state := make(map[string]int, len(jobs))
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case visiting:
+			return fmt.Errorf("jobs have a dependency cycle: %v", append(path, name))
+		case visited:
+			return nil
+		}
+		state[name] = visiting
+		for _, need := range jobs[name].Needs {
+			if _, ok := jobs[need]; !ok {
+				return fmt.Errorf("job %s needs unknown job %s", name, need)
+			} else if err := visit(need, append(path, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+		return nil
+	}
+	for _, name := range sortedJobNames(jobs) {
+		if jobs[name] == nil {
+			jobs[name] = &RunnerJob{}
+		}
+	}
+	for _, name := range sortedJobNames(jobs) {
+		if err := visit(name, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sortedJobNames(jobs map[string]*RunnerJob) []string {
+	names := make([]string, 0, len(jobs))
+	for name := range jobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type jobResult struct {
+	name   string
+	result DeployResult
+}
+
+// runJobs runs the jobs of the deployment. Jobs are started as soon as all the
+// jobs they need have succeeded, with at most Parallelism jobs running at once.
+// Jobs that need a job that didn't succeed are cancelled without running.
+func (rconf RunnerConfig) runJobs(ctx, deployCtx context.Context, stdoutWriter, stderrWriter io.Writer) (result DeployResult) {
+	parallelism := rconf.Parallelism
+	if parallelism <= 0 {
+		parallelism = len(rconf.Jobs)
+	}
+	var outputLock sync.Mutex
+	names := sortedJobNames(rconf.Jobs)
+	result.Jobs = make(map[string]DeployResult, len(names))
+	started := make(map[string]bool, len(names))
+	finished := make(chan jobResult)
+	running := 0
+
+	for len(result.Jobs) < len(names) {
+		for _, name := range names {
+			if running >= parallelism {
+				break
+			} else if started[name] {
+				continue
+			}
+			job := rconf.Jobs[name]
+			ready := true
+			for _, need := range job.Needs {
+				needResult, done := result.Jobs[need]
+				if !done {
+					ready = false
+				} else if needResult.Status != StatusSucceeded {
+					result.Jobs[name] = DeployResult{
+						Status: StatusCancelled,
+						Reason: fmt.Sprintf("needed job %s %s", need, needResult.Status),
+					}
+					started[name] = true
+					ready = false
+					break
+				}
+			}
+			if !ready {
+				continue
+			}
+			started[name] = true
+			running++
+			go func(name string, job *RunnerJob) {
+				stdout := &lineWriter{lock: &outputLock, target: stdoutWriter, prefix: fmt.Sprintf("[%s] ", name)}
+				stderr := &lineWriter{lock: &outputLock, target: stderrWriter, prefix: fmt.Sprintf("[%s] ", name)}
+				jobConf := rconf
+				jobConf.Environment = append(append([]string{}, rconf.Environment...), job.Environment...)
+				result := jobConf.runSteps(ctx, deployCtx, job.Steps, stdout, stderr)
+				stdout.Flush()
+				stderr.Flush()
+				finished <- jobResult{name, result}
+			}(name, job)
+		}
+		if running == 0 {
+			// Nothing is running, so the jobs that are left need a job that
+			// was cancelled in this round. They'll be cancelled in the next one.
+			continue
+		}
+		done := <-finished
+		running--
+		result.Jobs[done.name] = done.result
+		if done.result.Status != StatusSucceeded && len(result.Status) == 0 {
+			result.Status = done.result.Status
+			result.Reason = fmt.Sprintf("job %s %s: %s", done.name, done.result.Status, done.result.Reason)
+		}
+	}
+	if len(result.Status) == 0 {
+		result.Status = StatusSucceeded
+	}
+	return
+}
+
+// lineWriter writes complete lines to a shared writer with a prefix, so that
+// the output of concurrent jobs isn't mixed up in the middle of lines.
+type lineWriter struct {
+	lock   *sync.Mutex
+	target io.Writer
+	prefix string
+	buf    []byte
+}
+
+// Write implements io.Writer
+func (lw *lineWriter) Write(data []byte) (int, error) {
+	lw.lock.Lock()
+	defer lw.lock.Unlock()
+	lw.buf = append(lw.buf, data...)
+	for {
+		end := bytes.IndexByte(lw.buf, '\n')
+		if end < 0 {
+			break
+		}
+		lw.target.Write(append([]byte(lw.prefix), lw.buf[:end+1]...))
+		lw.buf = lw.buf[end+1:]
+	}
+	return len(data), nil
+}
+
+// Flush writes the last line even if it's incomplete.
+func (lw *lineWriter) Flush() {
+	lw.lock.Lock()
+	defer lw.lock.Unlock()
+	if len(lw.buf) > 0 {
+		lw.target.Write(append(append([]byte(lw.prefix), lw.buf...), '\n'))
+		lw.buf = nil
+	}
+}
@@ -0,0 +1,158 @@
+// gh-deployer - A simple server that listens for changes on GitHub and deploys projects.
+// Copyright (C) 2017 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+func parseJobs(t *testing.T, data string) map[string]*RunnerJob {
+	var jobs map[string]*RunnerJob
+	if err := yaml.Unmarshal([]byte(data), &jobs); err != nil {
+		t.Fatal(err)
+	}
+	return jobs
+}
+
+func TestValidateJobs(t *testing.T) {
+	tests := []struct {
+		jobs string
+		err  string
+	}{
+		{"{build: {}, test: {needs: [build]}, deploy: {needs: [build, test]}}", ""},
+		{"{build: , deploy: {needs: [build]}}", ""},
+		{"{a: {needs: [a]}}", "dependency cycle: [a a]"},
+		{"{a: {needs: [b]}, b: {needs: [c]}, c: {needs: [a]}}", "dependency cycle: [a b c a]"},
+		{"{a: {}, b: {needs: [c]}, c: {needs: [b]}}", "dependency cycle: [b c b]"},
+		{"{a: {needs: [missing]}}", "job a needs unknown job missing"},
+	}
+	for _, test := range tests {
+		err := validateJobs(parseJobs(t, test.jobs))
+		if len(test.err) == 0 && err != nil {
+			t.Errorf("validateJobs(%s) returned error: %v", test.jobs, err)
+		} else if len(test.err) > 0 && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("validateJobs(%s) = %v, want error containing %q", test.jobs, err, test.err)
+		}
+	}
+}
+
+func newJobsConfig(t *testing.T, jobs string, parallelism int) RunnerConfig {
+	return RunnerConfig{
+		Directory:       t.TempDir(),
+		Shell:           "/bin/sh",
+		ShellArgs:       []string{"-c"},
+		BaseEnvironment: []string{"PATH=" + os.Getenv("PATH")},
+		Jobs:            parseJobs(t, jobs),
+		Parallelism:     parallelism,
+	}
+}
+
+func TestRunJobsCancelsDependents(t *testing.T) {
+	rconf := newJobsConfig(t, `
+a: {steps: ["exit 3"]}
+b: {needs: [a], steps: [touch b]}
+c: {needs: [b], steps: [touch c]}
+d: {steps: [touch d]}
+`, 0)
+	ctx := context.Background()
+	result := rconf.runJobs(ctx, ctx, ioutil.Discard, ioutil.Discard)
+
+	if result.Status != StatusFailed || !strings.HasPrefix(result.Reason, "job a failed") {
+		t.Errorf("deployment %s: %s, want failed because of job a", result.Status, result.Reason)
+	}
+	expected := map[string]DeployResult{
+		"a": {Status: StatusFailed},
+		"b": {Status: StatusCancelled, Reason: "needed job a failed"},
+		"c": {Status: StatusCancelled, Reason: "needed job b cancelled"},
+		"d": {Status: StatusSucceeded},
+	}
+	for name, want := range expected {
+		got := result.Jobs[name]
+		if got.Status != want.Status || (len(want.Reason) > 0 && got.Reason != want.Reason) {
+			t.Errorf("job %s %s: %s, want %s: %s", name, got.Status, got.Reason, want.Status, want.Reason)
+		}
+	}
+	for _, name := range []string{"b", "c"} {
+		if _, err := os.Stat(filepath.Join(rconf.Directory, name)); err == nil {
+			t.Errorf("cancelled job %s was run", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(rconf.Directory, "d")); err != nil {
+		t.Errorf("independent job d wasn't run: %v", err)
+	}
+}
+
+// maxConcurrentJobs runs four jobs that log when they start and end, and
+// returns the highest number of jobs that were running at the same time.
+func maxConcurrentJobs(t *testing.T, parallelism int) int {
+	step := `["echo start >> log; sleep 0.2; echo end >> log"]`
+	rconf := newJobsConfig(t, "{a: {steps: "+step+"}, b: {steps: "+step+"}, c: {steps: "+step+"}, d: {steps: "+step+"}}", parallelism)
+	ctx := context.Background()
+	result := rconf.runJobs(ctx, ctx, ioutil.Discard, ioutil.Discard)
+	if result.Status != StatusSucceeded {
+		t.Fatalf("deployment %s: %s", result.Status, result.Reason)
+	}
+	output, err := ioutil.ReadFile(filepath.Join(rconf.Directory, "log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	running, max := 0, 0
+	for _, line := range strings.Fields(string(output)) {
+		if line == "start" {
+			running++
+		} else {
+			running--
+		}
+		if running > max {
+			max = running
+		}
+	}
+	return max
+}
+
+func TestRunJobsParallelism(t *testing.T) {
+	for _, parallelism := range []int{1, 2} {
+		if max := maxConcurrentJobs(t, parallelism); max > parallelism {
+			t.Errorf("%d jobs ran at the same time with parallelism %d", max, parallelism)
+		}
+	}
+	if max := maxConcurrentJobs(t, 0); max < 2 {
+		t.Errorf("jobs didn't run concurrently without a parallelism limit")
+	}
+}
+
+func TestRunJobsBackgroundProcess(t *testing.T) {
+	defer func(orig Config) { config = orig }(config)
+	config = Config{KillGracePeriod: 100 * time.Millisecond}
+	rconf := newJobsConfig(t, `{a: {steps: ["sleep 5 & echo started"]}}`, 0)
+	ctx := context.Background()
+	start := time.Now()
+	result := rconf.runJobs(ctx, ctx, ioutil.Discard, ioutil.Discard)
+	if result.Status != StatusSucceeded {
+		t.Errorf("deployment %s: %s, want succeeded", result.Status, result.Reason)
+	} else if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("deployment waited %s for the background process", elapsed)
+	}
+}
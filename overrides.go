@@ -0,0 +1,114 @@
+// gh-deployer - A simple server that listens for changes on GitHub and deploys projects.
+// Copyright (C) 2017 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"path"
+
+	"gopkg.in/yaml.v2"
+)
+
+// BranchOverride contains runner config changes for branches whose name
+// matches a glob pattern. Env, steps and sandbox replace the main environment,
+// steps and sandbox settings, while extra-env and extra-steps are added to them.
+type BranchOverride struct {
+	Pattern          string   `yaml:"-"`
+	Environment      []string `yaml:"env"`
+	ExtraEnvironment []string `yaml:"extra-env"`
+	Steps            []Step   `yaml:"steps"`
+	ExtraSteps       []Step   `yaml:"extra-steps"`
+	Sandbox          *Sandbox `yaml:"sandbox"`
+
+	// Commands is the old name of Steps.
+	Commands []Step `yaml:"commands"`
+}
+
+// BranchOverrides is a list of branch overrides in the order they're defined in.
+type BranchOverrides []BranchOverride
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (overrides *BranchOverrides) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var order yaml.MapSlice
+	if err := unmarshal(&order); err != nil {
+		return err
+	}
+	var byPattern map[string]BranchOverride
+	if err := unmarshal(&byPattern); err != nil {
+		return err
+	}
+	*overrides = make(BranchOverrides, 0, len(order))
+	for _, item := range order {
+		pattern, ok := item.Key.(string)
+		if !ok {
+			return fmt.Errorf("branch pattern %v is not a string", item.Key)
+		}
+		override := byPattern[pattern]
+		override.Pattern = pattern
+		*overrides = append(*overrides, override)
+	}
+	return nil
+}
+
+// normalize moves steps defined with the old commands key into Steps.
+func (override *BranchOverride) normalize() error {
+	if _, err := path.Match(override.Pattern, ""); err != nil {
+		return fmt.Errorf("invalid branch pattern %s: %v", override.Pattern, err)
+	} else if len(override.Commands) > 0 {
+		if len(override.Steps) > 0 {
+			return fmt.Errorf("steps and commands can't be used at the same time in branches.%s", override.Pattern)
+		}
+		override.Steps = override.Commands
+		override.Commands = nil
+	}
+	return nil
+}
+
+// ForBranch returns the runner config to use when deploying the given branch.
+// Only the first branches block whose pattern matches the branch is applied.
+func (rconf RunnerConfig) ForBranch(branch string) RunnerConfig {
+	rconf.Branch = branch
+	for _, override := range rconf.Branches {
+		if match, _ := path.Match(override.Pattern, branch); !match {
+			continue
+		}
+		if override.Environment != nil {
+			rconf.Environment = override.Environment
+		}
+		rconf.Environment = append(append([]string{}, rconf.Environment...), override.ExtraEnvironment...)
+		if override.Steps != nil {
+			rconf.Steps = override.Steps
+			rconf.Jobs = nil
+		}
+		rconf.Steps = append(append([]Step{}, rconf.Steps...), override.ExtraSteps...)
+		if override.Sandbox != nil {
+			rconf.Sandbox = override.Sandbox
+		}
+		break
+	}
+	return rconf
+}
+
+// RunsOn checks if the only and except branch patterns of the step allow
+// running it on the given branch. Steps with only patterns are never run when
+// deploying tags or pull requests, as there's no branch to match.
+func (step Step) RunsOn(branch string) bool {
+	if len(step.Only) > 0 && (len(branch) == 0 || !matchAny(step.Only, branch)) {
+		return false
+	}
+	return len(branch) == 0 || !matchAny(step.Except, branch)
+}
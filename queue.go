@@ -0,0 +1,222 @@
+// gh-deployer - A simple server that listens for changes on GitHub and deploys projects.
+// Copyright (C) 2017 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"maunium.net/go/githuuk"
+	log "maunium.net/go/maulogger"
+)
+
+// JobType tells what should be done to a branch, tag or pull request.
+type JobType int
+
+// Possible job types
+const (
+	JobDeploy JobType = iota
+	JobRemove
+)
+
+// Job is a single queued operation on a specific branch, tag or pull request of a repository.
+type Job struct {
+	Type        JobType
+	Owner       string
+	Repo        string
+	Ref         githuuk.Reference
+	PullRequest int
+	// The commit to deploy and the previous commit of the ref, if known.
+	Commit string
+	Before string
+	// Whether or not the push that created this job was a force push.
+	Forced bool
+	// The type of the event that created this job, the user who sent it and
+	// the user who pushed (only for push events).
+	EventType githuuk.EventType
+	Sender    string
+	Pusher    string
+	// The unique ID of this execution of the job.
+	ID string
+
+	ctx              context.Context
+	cancel           context.CancelFunc
+	lock             sync.Mutex
+	cancelInProgress bool
+}
+
+// Key returns the string that identifies the branch, tag or pull request this job operates on.
+func (job *Job) Key() string {
+	return fmt.Sprintf("%s/%s/%s", job.Owner, job.Repo, job.Ref)
+}
+
+// String returns a human-readable name of the branch, tag or pull request this job operates on.
+func (job *Job) String() string {
+	if job.IsPullRequest() {
+		return fmt.Sprintf("%s/%s pull request #%d", job.Owner, job.Repo, job.PullRequest)
+	} else if job.Ref.IsTag() {
+		return fmt.Sprintf("%s/%s tag %s", job.Owner, job.Repo, job.Ref.Name())
+	}
+	return fmt.Sprintf("%s/%s branch %s", job.Owner, job.Repo, job.Ref.Name())
+}
+
+// IsPullRequest checks if this job is for a pull request preview.
+func (job *Job) IsPullRequest() bool {
+	return job.PullRequest > 0
+}
+
+// Directory returns the path where the branch, tag or pull request of this job is deployed.
+func (job *Job) Directory() string {
+	if job.IsPullRequest() {
+		return config.GetPreviewPath(job.Owner, job.Repo, job.PullRequest)
+	} else if job.Ref.IsTag() {
+		return config.GetTagPath(job.Owner, job.Repo, job.Ref.Name())
+	}
+	return config.GetPath(job.Owner, job.Repo, job.Ref.Name())
+}
+
+// SetCancelInProgress sets whether or not this job should be cancelled when a
+// newer deployment for the same branch is queued.
+func (job *Job) SetCancelInProgress(cancel bool) {
+	job.lock.Lock()
+	job.cancelInProgress = cancel
+	job.lock.Unlock()
+}
+
+// Supersede cancels the job if it has cancel-in-progress enabled and returns
+// whether or not the job was cancelled.
+func (job *Job) Supersede() bool {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	if job.Type != JobDeploy || !job.cancelInProgress {
+		return false
+	}
+	job.cancel()
+	return true
+}
+
+// Execute runs the job synchronously.
+func (job *Job) Execute() {
+	switch job.Type {
+	case JobDeploy:
+		err := pull(job)
+		if err != nil {
+			log.Errorf("Not deploying %s: %s\n", job, err)
+			return
+		} else if job.ctx.Err() != nil {
+			log.Debugf("Deployment of %s was superseded before it started\n", job)
+			return
+		}
+		run(job)
+	case JobRemove:
+		if teardown(job) {
+			remove(job)
+		} else if config.ForceRemove {
+			log.Warnf("Teardown of %s failed, removing anyway\n", job)
+			remove(job)
+		} else {
+			log.Warnf("Teardown of %s failed, not removing %s\n", job, job.Directory())
+		}
+	}
+}
+
+// Queue is a job queue that runs jobs for different branches concurrently and
+// collapses multiple queued jobs for the same branch into the newest one.
+type Queue struct {
+	lock    sync.Mutex
+	cond    *sync.Cond
+	order   []string
+	pending map[string]*Job
+	running map[string]*Job
+}
+
+// NewQueue creates a new empty job queue.
+func NewQueue() *Queue {
+	queue := &Queue{
+		pending: make(map[string]*Job),
+		running: make(map[string]*Job),
+	}
+	queue.cond = sync.NewCond(&queue.lock)
+	return queue
+}
+
+// Start starts the given number of workers that execute queued jobs.
+func (queue *Queue) Start(workers int) {
+	for i := 0; i < workers; i++ {
+		go queue.work()
+	}
+}
+
+// Push adds a job to the queue. If a job for the same branch is already
+// waiting in the queue, it is replaced with the new job. If a deployment of
+// the same branch is currently running and has cancel-in-progress enabled,
+// the running deployment is cancelled.
+func (queue *Queue) Push(job *Job) {
+	key := job.Key()
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	if running, ok := queue.running[key]; ok && job.Type == JobDeploy && running.Supersede() {
+		log.Infof("Cancelling in-progress deployment of %s in favor of a newer push\n", key)
+	}
+	if _, ok := queue.pending[key]; ok {
+		log.Debugf("Replacing queued job for %s with newer job\n", key)
+	} else {
+		queue.order = append(queue.order, key)
+	}
+	queue.pending[key] = job
+	queue.cond.Signal()
+}
+
+func (queue *Queue) work() {
+	for {
+		job := queue.next()
+		job.Execute()
+		queue.finish(job)
+	}
+}
+
+// next waits until there is a queued job whose branch isn't already being
+// processed by another worker, then marks it running and returns it.
+func (queue *Queue) next() *Job {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	for {
+		for i, key := range queue.order {
+			if _, busy := queue.running[key]; busy {
+				continue
+			}
+			job := queue.pending[key]
+			queue.order = append(queue.order[:i], queue.order[i+1:]...)
+			delete(queue.pending, key)
+			job.ctx, job.cancel = context.WithCancel(context.Background())
+			job.ID = newDeployID()
+			job.cancelInProgress = config.CancelInProgress
+			queue.running[key] = job
+			return job
+		}
+		queue.cond.Wait()
+	}
+}
+
+func (queue *Queue) finish(job *Job) {
+	job.cancel()
+	queue.lock.Lock()
+	delete(queue.running, job.Key())
+	queue.lock.Unlock()
+	queue.cond.Broadcast()
+}
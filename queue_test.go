@@ -0,0 +1,110 @@
+// gh-deployer - A simple server that listens for changes on GitHub and deploys projects.
+// Copyright (C) 2017 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"maunium.net/go/githuuk"
+)
+
+func newTestJob(ref, commit string) *Job {
+	return &Job{Type: JobDeploy, Owner: "tulir", Repo: "gh-deployer", Ref: githuuk.Reference(ref), Commit: commit}
+}
+
+func TestQueueCoalescesPendingJobs(t *testing.T) {
+	queue := NewQueue()
+	queue.Push(newTestJob("refs/heads/master", "1"))
+	queue.Push(newTestJob("refs/heads/dev", "2"))
+	queue.Push(newTestJob("refs/heads/master", "3"))
+	queue.Push(newTestJob("refs/heads/master", "4"))
+
+	if len(queue.order) != 2 || len(queue.pending) != 2 {
+		t.Fatalf("queue has %d keys and %d pending jobs, want 2 of both", len(queue.order), len(queue.pending))
+	}
+	// The master branch keeps its place in the queue, but the newest job is run.
+	if job := queue.next(); job.Ref.Name() != "master" || job.Commit != "4" {
+		t.Errorf("first job is %s at %s, want master at 4", job.Ref.Name(), job.Commit)
+	}
+	if job := queue.next(); job.Ref.Name() != "dev" || job.Commit != "2" {
+		t.Errorf("second job is %s at %s, want dev at 2", job.Ref.Name(), job.Commit)
+	}
+	if len(queue.order) != 0 || len(queue.pending) != 0 {
+		t.Errorf("queue isn't empty after taking all jobs")
+	}
+}
+
+func TestQueueWaitsForRunningJobOfSameBranch(t *testing.T) {
+	queue := NewQueue()
+	queue.Push(newTestJob("refs/heads/master", "1"))
+	running := queue.next()
+
+	queue.Push(newTestJob("refs/heads/master", "2"))
+	queue.Push(newTestJob("refs/heads/master", "3"))
+	queue.Push(newTestJob("refs/heads/dev", "4"))
+	if job := queue.next(); job.Ref.Name() != "dev" {
+		t.Fatalf("got job for %s while master was running, want dev", job.Ref.Name())
+	}
+
+	next := make(chan *Job)
+	go func() {
+		next <- queue.next()
+	}()
+	select {
+	case job := <-next:
+		t.Fatalf("got job for %s at %s before the running master job finished", job.Ref.Name(), job.Commit)
+	case <-time.After(50 * time.Millisecond):
+	}
+	queue.finish(running)
+	select {
+	case job := <-next:
+		if job.Commit != "3" {
+			t.Errorf("got master at %s after the running job finished, want 3", job.Commit)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("queued master job wasn't started after the running job finished")
+	}
+}
+
+func TestQueueCancelInProgress(t *testing.T) {
+	defer func(orig Config) { config = orig }(config)
+	config = Config{}
+
+	queue := NewQueue()
+	queue.Push(newTestJob("refs/heads/master", "1"))
+	running := queue.next()
+	queue.Push(newTestJob("refs/heads/master", "2"))
+	if running.ctx.Err() != nil {
+		t.Fatal("running job was cancelled without cancel-in-progress")
+	}
+
+	running.SetCancelInProgress(true)
+	remove := newTestJob("refs/heads/master", "")
+	remove.Type = JobRemove
+	queue.Push(remove)
+	if running.ctx.Err() != nil {
+		t.Fatal("running job was cancelled by a remove job")
+	}
+	queue.Push(newTestJob("refs/heads/master", "3"))
+	if running.ctx.Err() == nil {
+		t.Error("running job wasn't cancelled by a newer push with cancel-in-progress")
+	}
+	if len(queue.pending) != 1 || queue.pending[running.Key()].Commit != "3" {
+		t.Error("newest job didn't replace the queued jobs")
+	}
+}
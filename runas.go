@@ -0,0 +1,109 @@
+// gh-deployer - A simple server that listens for changes on GitHub and deploys projects.
+// Copyright (C) 2017 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// RunAs is the user and groups that deployment commands are run as.
+type RunAs struct {
+	// The name or uid of the user.
+	User string `yaml:"user"`
+	// The name or gid of the primary group. Defaults to the primary group of the user.
+	Group string `yaml:"group"`
+	// The names or gids of supplementary groups.
+	Groups []string `yaml:"groups"`
+}
+
+// GetRunAs gets the user that the deployment commands of a repository are run
+// as. The repository config overrides the global config.
+func (config Config) GetRunAs(owner, repo string) RunAs {
+	if repoConf, _ := config.GetRepository(owner, repo); len(repoConf.RunAs.User) > 0 {
+		return repoConf.RunAs
+	}
+	return config.RunAs
+}
+
+// Resolve looks up the uid and gids to run commands with. The returned
+// variables point HOME, USER and LOGNAME to the user if it exists in the user
+// database. If no user is configured, the credential is nil and commands run
+// as the deployer.
+func (runAs RunAs) Resolve() (*syscall.Credential, []string, error) {
+	if len(runAs.User) == 0 {
+		if len(runAs.Group) > 0 || len(runAs.Groups) > 0 {
+			return nil, nil, fmt.Errorf("run-as groups can't be used without a user")
+		}
+		return nil, nil, nil
+	}
+	cred := &syscall.Credential{}
+	var env []string
+	var primaryGroup string
+	if usr, err := lookupUser(runAs.User); err == nil {
+		uid, _ := strconv.ParseUint(usr.Uid, 10, 32)
+		cred.Uid = uint32(uid)
+		primaryGroup = usr.Gid
+		env = append(env, "HOME="+usr.HomeDir, "USER="+usr.Username, "LOGNAME="+usr.Username)
+	} else if uid, numErr := strconv.ParseUint(runAs.User, 10, 32); numErr == nil {
+		cred.Uid = uint32(uid)
+	} else {
+		return nil, nil, fmt.Errorf("unknown user %s: %v", runAs.User, err)
+	}
+
+	if len(runAs.Group) > 0 {
+		primaryGroup = runAs.Group
+	} else if len(primaryGroup) == 0 {
+		return nil, nil, fmt.Errorf("group must be set for user %s, as it's not in the user database", runAs.User)
+	}
+	gid, err := lookupGroup(primaryGroup)
+	if err != nil {
+		return nil, nil, err
+	}
+	cred.Gid = gid
+	cred.Groups = make([]uint32, len(runAs.Groups))
+	for i, group := range runAs.Groups {
+		cred.Groups[i], err = lookupGroup(group)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return cred, env, nil
+}
+
+// lookupUser finds a user by name, or by uid if the name is numeric.
+func lookupUser(name string) (*user.User, error) {
+	if _, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return user.LookupId(name)
+	}
+	return user.Lookup(name)
+}
+
+// lookupGroup finds the gid of a group name. Numeric names are used as the gid directly.
+func lookupGroup(name string) (uint32, error) {
+	if gid, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint32(gid), nil
+	}
+	group, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, fmt.Errorf("unknown group %s: %v", name, err)
+	}
+	gid, err := strconv.ParseUint(group.Gid, 10, 32)
+	return uint32(gid), err
+}
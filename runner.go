@@ -17,7 +17,9 @@
 package main
 
 import (
-	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -25,100 +27,633 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
-	git "gopkg.in/src-d/go-git.v4"
 	"gopkg.in/yaml.v2"
 	log "maunium.net/go/maulogger"
 )
 
+// DeployStatus is the final state of a deployment.
+type DeployStatus string
+
+// Possible deployment statuses
+const (
+	StatusSucceeded DeployStatus = "succeeded"
+	StatusFailed    DeployStatus = "failed"
+	StatusCancelled DeployStatus = "cancelled"
+	StatusTimedOut  DeployStatus = "timed-out"
+)
+
+// DeployResult is the result of running the steps or jobs of a deployment.
+type DeployResult struct {
+	Status DeployStatus            `json:"status"`
+	Reason string                  `json:"reason,omitempty"`
+	Steps  []StepResult            `json:"steps,omitempty"`
+	Jobs   map[string]DeployResult `json:"jobs,omitempty"`
+}
+
+// exitSetupFailed is the exit status of the builtin shell and sandbox
+// processes when they fail before running the command. Like 126 and 127 from
+// shells, it means that the command couldn't be run at all.
+const exitSetupFailed = 125
+
+// StepResult is the result of a single step. The exit code is -1 if the
+// command couldn't be started, was killed by a signal or the step was skipped.
+type StepResult struct {
+	Name     string `json:"name,omitempty"`
+	Command  string `json:"command"`
+	ExitCode int    `json:"exit_code"`
+	Error    string `json:"error,omitempty"`
+	TimedOut bool   `json:"timed_out,omitempty"`
+	Skipped  bool   `json:"skipped,omitempty"`
+}
+
+// Step is a single command to run. Steps can be written either as plain
+// strings or as objects with additional options.
+type Step struct {
+	Name            string        `yaml:"name"`
+	Run             string        `yaml:"run"`
+	WorkDir         string        `yaml:"workdir"`
+	Environment     []string      `yaml:"env"`
+	Shell           string        `yaml:"shell"`
+	ShellArgs       []string      `yaml:"shell-args"`
+	Condition       string        `yaml:"condition"`
+	Only            []string      `yaml:"only"`
+	Except          []string      `yaml:"except"`
+	ContinueOnError bool          `yaml:"continue-on-error"`
+	Timeout         time.Duration `yaml:"timeout"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (step *Step) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&step.Run); err == nil {
+		return nil
+	}
+	type rawStep Step
+	return unmarshal((*rawStep)(step))
+}
+
+// String returns the name of the step, or the command if the step has no name.
+func (step Step) String() string {
+	if len(step.Name) > 0 {
+		return step.Name
+	}
+	return step.Run
+}
+
 // RunnerConfig contains the branch-specific deployment instructions.
 type RunnerConfig struct {
-	Directory   string   `yaml:"-"`
-	Shell       string   `yaml:"shell"`
-	ShellArgs   []string `yaml:"shell-args"`
-	Environment []string `yaml:"env"`
-	Commands    []string `yaml:"commands"`
+	Directory        string        `yaml:"-"`
+	Shell            string        `yaml:"shell"`
+	ShellArgs        []string      `yaml:"shell-args"`
+	Environment      []string      `yaml:"env"`
+	Secrets          []string      `yaml:"secrets"`
+	Steps            []Step        `yaml:"steps"`
+	Teardown         []Step        `yaml:"teardown"`
+	CancelInProgress *bool         `yaml:"cancel-in-progress"`
+	DeployTimeout    time.Duration `yaml:"deploy-timeout"`
+	Sandbox          *Sandbox      `yaml:"sandbox"`
+
+	// Commands is the old name of Steps.
+	Commands []Step `yaml:"commands"`
+
+	Jobs        map[string]*RunnerJob `yaml:"jobs"`
+	Parallelism int                   `yaml:"parallelism"`
+
+	Branches BranchOverrides `yaml:"branches"`
+	// The branch being deployed, or an empty string for tags and pull requests.
+	Branch string `yaml:"-"`
+	// The commit being deployed.
+	Commit string `yaml:"-"`
+	// The values of deploy secrets that should be masked in the output.
+	Masked []string `yaml:"-"`
+	// The environment from the server config that the runner config environment is added to.
+	BaseEnvironment []string `yaml:"-"`
+	// The user and groups to run commands as, or nil to run them as the deployer.
+	Credential *syscall.Credential `yaml:"-"`
+
+	Tags *RunnerConfig `yaml:"tags"`
+
+	Preview         []Step `yaml:"preview"`
+	PreviewTeardown []Step `yaml:"preview-teardown"`
 }
 
-func run(owner, repo, branch string) {
-	log.Debugf("Preparing to deploy %s/%s branch %s\n", owner, repo, branch)
-	dir := config.GetPath(owner, repo, branch)
-	dat, err := ioutil.ReadFile(filepath.Join(dir, ".gh-deployer.yaml"))
+func readRunnerConfig(job *Job) (runConfig RunnerConfig, err error) {
+	// The runner config may be in a workspace owned by the run-as user, so don't
+	// follow symlinks that could point to files only the deployer can read.
+	file, err := os.OpenFile(filepath.Join(job.Directory(), ".gh-deployer.yaml"), os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return
+	}
+	dat, err := ioutil.ReadAll(file)
+	file.Close()
 	if err != nil {
-		log.Errorf("Failed to read deployer run config of %s/%s branch %s: %s\n", owner, repo, branch, err)
 		return
 	}
-
-	runConfig := RunnerConfig{}
 	err = yaml.Unmarshal(dat, &runConfig)
 	if err != nil {
-		log.Errorf("Failed to parse deployer run config of %s/%s branch %s: %s\n", owner, repo, branch, err)
 		return
 	}
-	runConfig.Directory = dir
-	runConfig.run()
-	log.Debugf("Deployment of %s/%s branch %s completed.\n", owner, repo, branch)
+	err = runConfig.normalize()
+	runConfig.Directory = job.Directory()
+	return
+}
+
+// normalize moves steps defined with the old commands key into Steps and
+// checks that the jobs are valid.
+func (rconf *RunnerConfig) normalize() error {
+	if len(rconf.Commands) > 0 {
+		if len(rconf.Steps) > 0 {
+			return fmt.Errorf("steps and commands can't be used at the same time")
+		}
+		rconf.Steps = rconf.Commands
+		rconf.Commands = nil
+	}
+	if len(rconf.Jobs) > 0 {
+		if len(rconf.Steps) > 0 {
+			return fmt.Errorf("steps and jobs can't be used at the same time")
+		} else if err := validateJobs(rconf.Jobs); err != nil {
+			return err
+		}
+	}
+	for i := range rconf.Branches {
+		override := &rconf.Branches[i]
+		if err := override.normalize(); err != nil {
+			return err
+		} else if len(rconf.Jobs) > 0 && override.Steps == nil && len(override.ExtraSteps) > 0 {
+			return fmt.Errorf("extra-steps can't be added to jobs in branches.%s", override.Pattern)
+		}
+	}
+	if rconf.Tags != nil {
+		return rconf.Tags.normalize()
+	}
+	return nil
+}
+
+// ForPreview returns the runner config to use when deploying a pull request preview.
+func (rconf RunnerConfig) ForPreview(number int) RunnerConfig {
+	rconf.Steps = rconf.Preview
+	rconf.Jobs = nil
+	rconf.Teardown = rconf.PreviewTeardown
+	rconf.Environment = append(rconf.Environment, fmt.Sprintf("PR_NUMBER=%d", number))
+	return rconf
+}
+
+// ForTag returns the runner config to use when deploying a tag. If the config
+// has a tags section, its steps are used and its environment is appended
+// to the main environment.
+func (rconf RunnerConfig) ForTag() RunnerConfig {
+	if rconf.Tags == nil {
+		return rconf
+	}
+	tagConf := *rconf.Tags
+	tagConf.Directory = rconf.Directory
+	if len(tagConf.Shell) == 0 {
+		tagConf.Shell = rconf.Shell
+		tagConf.ShellArgs = rconf.ShellArgs
+	}
+	tagConf.Environment = append(append([]string{}, rconf.Environment...), tagConf.Environment...)
+	tagConf.Secrets = append(append([]string{}, rconf.Secrets...), tagConf.Secrets...)
+	if tagConf.CancelInProgress == nil {
+		tagConf.CancelInProgress = rconf.CancelInProgress
+	}
+	if tagConf.DeployTimeout == 0 {
+		tagConf.DeployTimeout = rconf.DeployTimeout
+	}
+	if tagConf.Sandbox == nil {
+		tagConf.Sandbox = rconf.Sandbox
+	}
+	if tagConf.Parallelism == 0 {
+		tagConf.Parallelism = rconf.Parallelism
+	}
+	if len(tagConf.Teardown) == 0 {
+		tagConf.Teardown = rconf.Teardown
+	}
+	return tagConf
+}
+
+// prepareRunnerConfig reads the runner config of the job and adjusts it for
+// the type of the job.
+func prepareRunnerConfig(job *Job) (runConfig RunnerConfig, err error) {
+	runConfig, err = readRunnerConfig(job)
+	if err != nil {
+		return
+	}
+
+	if job.IsPullRequest() {
+		runConfig = runConfig.ForPreview(job.PullRequest)
+	} else if job.Ref.IsTag() {
+		runConfig = runConfig.ForTag()
+		runConfig.Environment = append(runConfig.Environment, "IS_TAG=true", fmt.Sprintf("TAG=%s", job.Ref.Name()))
+	} else {
+		runConfig = runConfig.ForBranch(job.Ref.Name())
+	}
+	if !job.Ref.IsTag() {
+		runConfig.Environment = append(runConfig.Environment, "IS_TAG=false")
+	}
+	runConfig.BaseEnvironment = config.GetEnvironment(job.Owner, job.Repo)
+	credential, userEnv, err := config.GetRunAs(job.Owner, job.Repo).Resolve()
+	if err != nil {
+		err = fmt.Errorf("failed to resolve run-as user: %v", err)
+		return
+	}
+	runConfig.Credential = credential
+	runConfig.BaseEnvironment = append(runConfig.BaseEnvironment, userEnv...)
+	runConfig.Sandbox = config.GetSandbox(job, runConfig.Sandbox)
+
+	r, err := openRepository(runConfig.Directory)
+	if err != nil {
+		return
+	}
+	ref, err := r.Head()
+	if err != nil {
+		return
+	}
+	commit, err := r.CommitObject(ref.Hash())
+	if err != nil {
+		return
+	}
+	runConfig.Commit = ref.Hash().String()
+	after := job.Commit
+	if len(after) == 0 {
+		after = runConfig.Commit
+	}
+	workspace, _ := filepath.Abs(runConfig.Directory)
+	runConfig.Environment = append(runConfig.Environment,
+		fmt.Sprintf("HEAD=%s", ref.Hash()),
+		"REPO_OWNER="+job.Owner,
+		"REPO_NAME="+job.Repo,
+		"BEFORE="+job.Before,
+		"AFTER="+after,
+		"PUSHER="+job.Pusher,
+		"SENDER="+job.Sender,
+		"COMMIT_MESSAGE="+strings.TrimRight(commit.Message, "\n"),
+		"DEPLOY_ID="+job.ID,
+		"PREVIOUS_DEPLOYED_SHA="+lastDeployedCommit(runConfig.Directory),
+		"EVENT_TYPE="+string(job.EventType),
+		"WORKSPACE="+workspace)
+	if job.Ref.IsBranch() {
+		runConfig.Environment = append(runConfig.Environment, "BRANCH="+job.Ref.Name())
+	}
+	return
+}
+
+// teardown runs the teardown commands of the job in the workspace with the
+// environment of the last deployment and returns whether or not they succeeded.
+func teardown(job *Job) bool {
+	runConfig, err := prepareRunnerConfig(job)
+	if os.IsNotExist(err) {
+		return true
+	} else if err != nil {
+		log.Errorf("Failed to read deployer run config of %s: %s\n", job, err)
+		return false
+	} else if len(runConfig.Teardown) == 0 {
+		return true
+	}
+
+	dat, err := readStateFile(filepath.Join(runConfig.Directory, ".environment"))
+	if err == nil {
+		err = json.Unmarshal(dat, &runConfig.Environment)
+	}
+	if err != nil {
+		log.Warnf("Failed to read environment of last deployment of %s: %s\n", job, err)
+	}
+
+	log.Debugln("Tearing down", job)
+	runConfig.Steps = runConfig.Teardown
+	runConfig.Jobs = nil
+	err = injectSecrets(job, &runConfig)
+	if err != nil {
+		log.Errorf("Not tearing down %s: %s\n", job, err)
+		return false
+	}
+	result := runConfig.run(job.ctx)
+	if result.Status != StatusSucceeded {
+		log.Errorf("Teardown of %s %s: %s\n", job, result.Status, result.Reason)
+		return false
+	}
+	return true
+}
+
+func run(job *Job) {
+	log.Debugln("Preparing to deploy", job)
+	dir := job.Directory()
+	runConfig, err := prepareRunnerConfig(job)
+	if err != nil {
+		log.Errorf("Failed to read deployer run config of %s: %s\n", job, err)
+		return
+	} else if job.IsPullRequest() && len(runConfig.Steps) == 0 {
+		log.Debugf("Not deploying %s: no preview commands configured\n", job)
+		return
+	}
+
+	if runConfig.CancelInProgress != nil {
+		job.SetCancelInProgress(*runConfig.CancelInProgress)
+	}
+	// The environment is saved before adding secrets, so that they're not
+	// stored on disk. Teardown adds them again when needed.
+	env, _ := json.Marshal(runConfig.Environment)
+	err = writeStateFile(filepath.Join(dir, ".environment"), env, 0600)
+	if err != nil {
+		log.Errorf("Failed to save deployment environment of %s: %s\n", job, err)
+	}
+	err = injectSecrets(job, &runConfig)
+	if err != nil {
+		log.Errorf("Not deploying %s: %s\n", job, err)
+		return
+	}
+	if runConfig.Credential != nil {
+		err = chownWorkspace(dir, runConfig.Credential)
+		if err != nil {
+			log.Errorf("Not deploying %s: failed to change owner of workspace: %s\n", job, err)
+			return
+		}
+	}
+	startedAt := time.Now()
+	result := runConfig.run(job.ctx)
+	err = addHistory(dir, DeploymentRecord{
+		ID:         job.ID,
+		Commit:     runConfig.Commit,
+		Status:     result.Status,
+		EventType:  job.EventType,
+		Sender:     job.Sender,
+		StartedAt:  startedAt,
+		FinishedAt: time.Now(),
+	})
+	if err != nil {
+		log.Errorf("Failed to update deployment history of %s: %s\n", job, err)
+	}
+	dat, _ := json.MarshalIndent(result, "", "  ")
+	err = writeStateFile(filepath.Join(dir, ".result"), dat, 0644)
+	if err != nil {
+		log.Errorf("Failed to write deployment result of %s: %s\n", job, err)
+	}
+	switch result.Status {
+	case StatusSucceeded:
+		log.Infof("Deployment of %s succeeded.\n", job)
+	case StatusCancelled:
+		log.Infof("Deployment of %s was cancelled: %s\n", job, result.Reason)
+	default:
+		log.Errorf("Deployment of %s %s: %s\n", job, result.Status, result.Reason)
+	}
+}
+
+// waitCommand waits for the given command to exit. If the context is done
+// before that, the whole process group of the command is sent SIGTERM, and
+// SIGKILL if it hasn't exited after the configured grace period.
+func waitCommand(ctx context.Context, cmd *exec.Cmd) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+			return
+		}
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+		select {
+		case <-time.After(config.KillGracePeriod):
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		case <-done:
+		}
+	}()
+	return cmd.Wait()
+}
+
+// GetDeployTimeout gets the timeout of the whole deployment, taking the
+// server-side maximum into account. Zero means no timeout.
+func (rconf RunnerConfig) GetDeployTimeout() time.Duration {
+	if config.MaxDeployTimeout > 0 && (rconf.DeployTimeout <= 0 || rconf.DeployTimeout > config.MaxDeployTimeout) {
+		return config.MaxDeployTimeout
+	}
+	return rconf.DeployTimeout
+}
+
+// interrupted checks if the deployment has been superseded by a newer push or
+// has timed out, and marks the result accordingly if it has.
+func (rconf RunnerConfig) interrupted(ctx, deployCtx context.Context, result *DeployResult, infoMessages io.Writer, note string) bool {
+	if ctx.Err() != nil {
+		fmt.Fprintf(infoMessages, "[gh-deployer] Deployment superseded by a newer push.%s\n", note)
+		result.Status = StatusCancelled
+		result.Reason = "superseded by a newer push"
+		return true
+	} else if deployCtx.Err() != nil {
+		fmt.Fprintf(infoMessages, "[gh-deployer] Deployment timed out.%s\n", note)
+		result.Status = StatusTimedOut
+		result.Reason = fmt.Sprintf("deployment timed out after %s", rconf.GetDeployTimeout())
+		return true
+	}
+	return false
+}
+
+func (rconf RunnerConfig) run(ctx context.Context) DeployResult {
+	stdoutFile, err := createStateFile(filepath.Join(rconf.Directory, ".stdout"), 0644)
+	if err != nil {
+		return DeployResult{Status: StatusFailed, Reason: fmt.Sprintf("failed to create output file: %v", err)}
+	}
+	defer stdoutFile.Close()
+	stderrFile, err := createStateFile(filepath.Join(rconf.Directory, ".stderr"), 0644)
+	if err != nil {
+		return DeployResult{Status: StatusFailed, Reason: fmt.Sprintf("failed to create output file: %v", err)}
+	}
+	defer stderrFile.Close()
+	var stdoutWriter, stderrWriter io.Writer = stdoutFile, stderrFile
+	if len(rconf.Masked) > 0 {
+		masker := newMasker(rconf.Masked)
+		stdoutMask := &maskWriter{target: stdoutFile, masker: masker}
+		stderrMask := &maskWriter{target: stderrFile, masker: masker}
+		defer stdoutMask.Flush()
+		defer stderrMask.Flush()
+		stdoutWriter, stderrWriter = stdoutMask, stderrMask
+	}
+
+	deployCtx := ctx
+	if timeout := rconf.GetDeployTimeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		deployCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	fmt.Fprintln(io.MultiWriter(stdoutWriter, stderrWriter), "[gh-deployer] Deploying project...")
+	var result DeployResult
+	if len(rconf.Jobs) > 0 {
+		result = rconf.runJobs(ctx, deployCtx, stdoutWriter, stderrWriter)
+	} else {
+		result = rconf.runSteps(ctx, deployCtx, rconf.Steps, stdoutWriter, stderrWriter)
+	}
+	if len(rconf.Masked) > 0 {
+		result = maskResult(result, newMasker(rconf.Masked))
+	}
+	return result
 }
 
-func (rconf RunnerConfig) run() {
-	stdoutFile, _ := os.Create(filepath.Join(rconf.Directory, ".stdout"))
-	stderrFile, _ := os.Create(filepath.Join(rconf.Directory, ".stderr"))
-	stdoutWriter := bufio.NewWriter(stdoutFile)
-	stderrWriter := bufio.NewWriter(stderrFile)
+// runSteps runs the given steps sequentially until one of them fails.
+func (rconf RunnerConfig) runSteps(ctx, deployCtx context.Context, steps []Step, stdoutWriter, stderrWriter io.Writer) (result DeployResult) {
 	infoMessages := io.MultiWriter(stdoutWriter, stderrWriter)
+	result.Status = StatusSucceeded
+	result.Steps = make([]StepResult, 0, len(steps))
+	for i, step := range steps {
+		if rconf.interrupted(ctx, deployCtx, &result, infoMessages, "") {
+			return
+		}
 
-	r, _ := git.PlainOpen(rconf.Directory)
-	ref, _ := r.Head()
-	rconf.Environment = append(rconf.Environment, fmt.Sprintf("HEAD=%s", ref.Hash()))
-
-	fmt.Fprintln(infoMessages, "[gh-deployer] Deploying project...")
-
-	for _, rawCommand := range rconf.Commands {
-		var command string
-		var args []string
-		if len(rconf.Shell) > 0 {
-			command = rconf.Shell
-			args = append(rconf.ShellArgs, rawCommand)
-		} else {
-			parts := strings.Split(rawCommand, " ")
-			command = parts[0]
-			if len(parts) > 1 {
-				args = parts[1:]
+		fmt.Fprintln(infoMessages, "--------------------------------------------------")
+		if !step.RunsOn(rconf.Branch) {
+			fmt.Fprintf(infoMessages, "[gh-deployer] Skipping step %s, as it's not enabled for this branch.\n", step)
+			result.Steps = append(result.Steps, StepResult{Name: step.Name, Command: step.Run, ExitCode: -1, Skipped: true})
+			continue
+		}
+		var stepResult StepResult
+		if len(step.Condition) > 0 {
+			fmt.Fprintln(infoMessages, "[gh-deployer] Checking condition of step", step)
+			stepResult = rconf.runStep(deployCtx, step, step.Condition, stdoutWriter, stderrWriter)
+			if rconf.interrupted(ctx, deployCtx, &result, infoMessages, " Command killed.") {
+				return
+			} else if stepResult.ExitCode > 0 && stepResult.ExitCode < exitSetupFailed && !stepResult.TimedOut {
+				fmt.Fprintln(infoMessages, "[gh-deployer] Condition not met, skipping step.")
+				result.Steps = append(result.Steps, StepResult{Name: step.Name, Command: step.Run, ExitCode: -1, Skipped: true})
+				continue
+			} else if len(stepResult.Error) > 0 {
+				stepResult.Error = fmt.Sprintf("condition %s", stepResult.Error)
 			}
 		}
-		fmt.Fprintln(infoMessages, "--------------------------------------------------")
-		fmt.Fprintln(infoMessages, "[gh-deployer] Preparing command", rawCommand)
+		if len(stepResult.Error) == 0 {
+			fmt.Fprintln(infoMessages, "[gh-deployer] Preparing step", step)
+			stepResult = rconf.runStep(deployCtx, step, step.Run, stdoutWriter, stderrWriter)
+		}
+		result.Steps = append(result.Steps, stepResult)
 
-		cmd := exec.Command(command, args...)
-		cmd.Dir = rconf.Directory
-		cmd.Env = append(os.Environ(), rconf.Environment...)
+		if rconf.interrupted(ctx, deployCtx, &result, infoMessages, " Command killed.") {
+			return
+		} else if len(stepResult.Error) == 0 {
+			fmt.Fprintln(infoMessages, "[gh-deployer] Step finished.")
+			continue
+		}
 
-		stdout, err := cmd.StdoutPipe()
-		if err != nil {
-			fmt.Fprintf(stderrWriter, "[gh-deployer] Failed to open stdout of command: %s!\n", err)
-			stdout = nil
+		fmt.Fprintf(stderrWriter, "[gh-deployer] Step failed: %s!\n", stepResult.Error)
+		if step.ContinueOnError {
+			fmt.Fprintln(infoMessages, "[gh-deployer] Continuing anyway, as continue-on-error is set.")
+			continue
 		}
-		stderr, err := cmd.StderrPipe()
-		if err != nil {
-			fmt.Fprintf(stderrWriter, "[gh-deployer] Failed to open stderr of command: %s!\n", err)
-			stderr = nil
+		fmt.Fprintln(infoMessages, "[gh-deployer] Stopping deployment.")
+		result.Status = StatusFailed
+		if stepResult.TimedOut {
+			result.Status = StatusTimedOut
 		}
+		result.Reason = fmt.Sprintf("step #%d (%s) failed: %s", i+1, step, stepResult.Error)
+		return
+	}
+	return
+}
+
+// stepShell returns the shell and shell arguments to run the step with.
+// Steps that set their own shell default to the -c shell argument.
+func (rconf RunnerConfig) stepShell(step Step) (string, []string) {
+	if len(step.Shell) == 0 {
+		return rconf.Shell, rconf.ShellArgs
+	} else if len(step.ShellArgs) == 0 && step.Shell != BuiltinShell {
+		return step.Shell, []string{"-c"}
+	}
+	return step.Shell, step.ShellArgs
+}
+
+// stepDirectory returns the directory to run the step in. The workdir of the
+// step is relative to the deployment directory and may not point outside it.
+func (rconf RunnerConfig) stepDirectory(step Step) (string, error) {
+	dir := filepath.Join(rconf.Directory, step.WorkDir)
+	rel, err := filepath.Rel(rconf.Directory, dir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("workdir %s is outside the deployment directory", step.WorkDir)
+	}
+	return dir, nil
+}
+
+// runStep runs the given command (either the step itself or its condition)
+// with the settings of the step.
+func (rconf RunnerConfig) runStep(ctx context.Context, step Step, command string, stdout, stderr io.Writer) StepResult {
+	result := StepResult{Name: step.Name, Command: command, ExitCode: -1}
+
+	if step.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, step.Timeout)
+		defer cancel()
+	}
+
+	dir, err := rconf.stepDirectory(step)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	env := append(append(append([]string{}, rconf.BaseEnvironment...), rconf.Environment...), step.Environment...)
+	shell, shellArgs := rconf.stepShell(step)
+	if shell == BuiltinShell {
+		shell, shellArgs = builtinShellCommand()
+	}
+	result.ExitCode, err = rconf.runExternal(ctx, shell, shellArgs, command, dir, env, stdout, stderr)
+	if ctx.Err() == context.DeadlineExceeded && step.Timeout > 0 {
+		result.TimedOut = true
+		result.Error = fmt.Sprintf("timed out after %s", step.Timeout)
+	} else if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
 
-		err = cmd.Start()
+// runExternal runs a command either in the given shell or directly as a
+// program if there's no shell.
+func (rconf RunnerConfig) runExternal(ctx context.Context, shell string, shellArgs []string, command, dir string, env []string, stdout, stderr io.Writer) (int, error) {
+	var name string
+	var args []string
+	if len(shell) > 0 {
+		name = shell
+		args = append(append([]string{}, shellArgs...), command)
+	} else {
+		words, err := splitWords(command, envLookup(env))
 		if err != nil {
-			fmt.Fprintf(stderrWriter, "[gh-deployer] Failed to execute command: %s!\n", err)
-			continue
+			return -1, fmt.Errorf("failed to parse command: %v", err)
+		} else if len(words) == 0 {
+			return -1, fmt.Errorf("empty command")
 		}
-		fmt.Fprintln(infoMessages, "[gh-deployer] Command started. Piping output...")
+		name = words[0]
+		args = words[1:]
+	}
 
-		if stdout != nil {
-			go io.Copy(stdoutWriter, stdout)
-		}
-		if stderr != nil {
-			go io.Copy(stderrWriter, stderr)
+	cmd := exec.Command(name, args...)
+	cmd.Dir = dir
+	cmd.Env = env
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	// Run the command in its own process group so that it can be killed
+	// along with all its children if the deployment is cancelled or times out.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Credential: rconf.Credential}
+	// If the output isn't written directly to a file, don't wait forever for
+	// background processes that inherited the output pipes.
+	cmd.WaitDelay = config.KillGracePeriod
+
+	sandboxed := rconf.Sandbox != nil && rconf.Sandbox.Enabled
+	if sandboxed {
+		cleanup, err := rconf.Sandbox.wrapCommand(cmd, rconf.Directory, rconf.Credential)
+		if err != nil {
+			return -1, fmt.Errorf("failed to prepare sandbox: %v", err)
 		}
-		err = cmd.Wait()
-		fmt.Fprintf(stderrWriter, "[gh-deployer] Error while waiting for command: %s!\n", err)
-		fmt.Fprintln(infoMessages, "[gh-deployer] Command execution finished.")
+		defer cleanup()
+	}
+
+	err := cmd.Start()
+	if err != nil && sandboxed {
+		return -1, sandboxStartError(err)
+	} else if err != nil {
+		return -1, fmt.Errorf("failed to start: %v", err)
+	}
+	fmt.Fprintln(io.MultiWriter(stdout, stderr), "[gh-deployer] Command started. Piping output...")
+
+	err = waitCommand(ctx, cmd)
+	exitCode := cmd.ProcessState.ExitCode()
+	if errors.Is(err, exec.ErrWaitDelay) && exitCode == 0 {
+		// The command succeeded, but left a background process running with the output pipes.
+		fmt.Fprintln(stderr, "[gh-deployer] Command exited, but background processes are still holding its output open. Their further output is discarded.")
+		err = nil
 	}
+	return exitCode, err
 }
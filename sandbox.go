@@ -0,0 +1,135 @@
+// gh-deployer - A simple server that listens for changes on GitHub and deploys projects.
+// Copyright (C) 2017 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// sandboxArg is the first argument that makes gh-deployer set up the sandbox
+// and run a command in it instead of starting the server.
+const sandboxArg = "__sandbox"
+
+// defaultSandboxReadOnly is the list of host paths available in the sandbox
+// if read-only isn't set in the runner config.
+var defaultSandboxReadOnly = []string{
+	"/usr", "/bin", "/sbin", "/lib", "/lib32", "/lib64",
+	"/etc/ssl", "/etc/resolv.conf", "/etc/passwd", "/etc/group",
+}
+
+// Sandbox contains the settings for running deployment commands in new Linux
+// namespaces, where only the workspace and some read-only paths of the host
+// filesystem are available.
+type Sandbox struct {
+	Enabled bool `yaml:"enabled"`
+	// Whether or not to run the commands in a new network namespace that only
+	// has a loopback interface.
+	IsolateNetwork bool `yaml:"isolate-network"`
+	// Absolute host paths to make available read-only in the sandbox.
+	ReadOnly []string `yaml:"read-only"`
+}
+
+// SandboxPolicy is a sandbox setting in the server config. The sandbox
+// settings of the runner config can only make it stricter for the jobs the
+// policy applies to.
+type SandboxPolicy struct {
+	Sandbox `yaml:",inline"`
+	// The branches and tags the policy applies to, and whether or not it
+	// applies to pull request previews. If none are set, the policy applies to
+	// all jobs.
+	Branches []string `yaml:"branches"`
+	Tags     []string `yaml:"tags"`
+	Previews bool     `yaml:"previews"`
+}
+
+// AppliesTo checks if the policy should be enforced for the given job.
+func (policy SandboxPolicy) AppliesTo(job *Job) bool {
+	if !policy.Enabled {
+		return false
+	} else if len(policy.Branches) == 0 && len(policy.Tags) == 0 && !policy.Previews {
+		return true
+	} else if job.IsPullRequest() {
+		return policy.Previews
+	} else if job.Ref.IsTag() {
+		return matchAny(policy.Tags, job.Ref.Name())
+	}
+	return matchAny(policy.Branches, job.Ref.Name())
+}
+
+// Restrict combines the given sandbox settings from the runner config with the
+// policy. The sandbox is always enabled, the network is isolated if either
+// one isolates it and only read-only paths allowed by the policy are kept.
+func (policy SandboxPolicy) Restrict(sandbox *Sandbox) *Sandbox {
+	allowed := policy.ReadOnly
+	if allowed == nil {
+		allowed = defaultSandboxReadOnly
+	}
+	restricted := Sandbox{
+		Enabled:        true,
+		IsolateNetwork: policy.IsolateNetwork,
+		ReadOnly:       allowed,
+	}
+	if sandbox == nil {
+		return &restricted
+	}
+	restricted.IsolateNetwork = restricted.IsolateNetwork || sandbox.IsolateNetwork
+	if sandbox.ReadOnly != nil {
+		restricted.ReadOnly = []string{}
+		for _, path := range sandbox.ReadOnly {
+			// Relative paths are kept so that the sandbox refuses to start.
+			if !filepath.IsAbs(path) || underAny(filepath.Clean(path), allowed) {
+				restricted.ReadOnly = append(restricted.ReadOnly, path)
+			}
+		}
+	}
+	return &restricted
+}
+
+// GetSandbox applies the global and repository sandbox policies that apply to
+// the given job to the sandbox settings of the runner config.
+func (config Config) GetSandbox(job *Job, sandbox *Sandbox) *Sandbox {
+	repoConf, _ := config.GetRepository(job.Owner, job.Repo)
+	for _, policy := range []SandboxPolicy{config.Sandbox, repoConf.Sandbox} {
+		if policy.AppliesTo(job) {
+			sandbox = policy.Restrict(sandbox)
+		}
+	}
+	return sandbox
+}
+
+// underAny checks if the given path is one of the given directories or inside one of them.
+func underAny(path string, dirs []string) bool {
+	for _, dir := range dirs {
+		if path == dir || strings.HasPrefix(path, strings.TrimSuffix(dir, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// sandboxSpec is passed from the deployer to the sandbox process to tell it
+// what to set up before running the command.
+type sandboxSpec struct {
+	Root           string   `json:"root"`
+	Workspace      string   `json:"workspace"`
+	ReadOnly       []string `json:"read_only"`
+	IsolateNetwork bool     `json:"isolate_network"`
+	UID            uint32   `json:"uid"`
+	GID            uint32   `json:"gid"`
+	Groups         []uint32 `json:"groups,omitempty"`
+}
@@ -0,0 +1,396 @@
+// gh-deployer - A simple server that listens for changes on GitHub and deploys projects.
+// Copyright (C) 2017 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// wrapCommand changes a command to start the sandbox, which then runs the
+// original command. The command runs as the run-as user if there is one, or
+// as the user of the deployer otherwise. The returned function removes the
+// temporary sandbox root directory after the command has exited.
+func (sandbox Sandbox) wrapCommand(cmd *exec.Cmd, workspace string, cred *syscall.Credential) (func(), error) {
+	if cmd.Err != nil {
+		return nil, cmd.Err
+	}
+	uid, gid := uint32(os.Getuid()), uint32(os.Getgid())
+	var groups []uint32
+	if cred != nil {
+		uid, gid, groups = cred.Uid, cred.Gid, cred.Groups
+	}
+	if uid == 0 {
+		return nil, fmt.Errorf("commands can't be run as root in the sandbox, configure a run-as user")
+	}
+	workspace, err := filepath.Abs(workspace)
+	if err != nil {
+		return nil, err
+	}
+	readOnly := sandbox.ReadOnly
+	if readOnly == nil {
+		readOnly = defaultSandboxReadOnly
+	}
+	for _, path := range readOnly {
+		if !filepath.IsAbs(path) {
+			return nil, fmt.Errorf("read-only path %s is not absolute", path)
+		}
+	}
+	// Make sure the program itself is available, e.g. if it's the builtin shell.
+	if filepath.IsAbs(cmd.Path) && !underAny(cmd.Path, append([]string{workspace}, readOnly...)) {
+		readOnly = append(append([]string{}, readOnly...), cmd.Path)
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	root, err := ioutil.TempDir("", "gh-deployer-sandbox-")
+	if err != nil {
+		return nil, err
+	}
+
+	// The sandbox process is root in its own user namespace, so that it can set
+	// up the mounts. That root user is mapped to the user the command should
+	// run as, and the command gets its own user namespace inside that one
+	// where it's that user again without any privileges.
+	gidMappings := []syscall.SysProcIDMap{{ContainerID: 0, HostID: int(gid), Size: 1}}
+	var extraGroups []uint32
+	for _, group := range groups {
+		if group == 0 {
+			os.Remove(root)
+			return nil, fmt.Errorf("the root group can't be used in the sandbox")
+		} else if group != gid && !containsID(extraGroups, group) {
+			extraGroups = append(extraGroups, group)
+			gidMappings = append(gidMappings, syscall.SysProcIDMap{ContainerID: int(group), HostID: int(group), Size: 1})
+		}
+	}
+	// Supplementary groups can only be set by a privileged deployer. In that
+	// case they're always set, so that the groups of the deployer aren't inherited.
+	privileged := os.Geteuid() == 0
+	cloneflags := uintptr(syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWIPC)
+	if sandbox.IsolateNetwork {
+		cloneflags |= syscall.CLONE_NEWNET
+	}
+	spec, _ := json.Marshal(sandboxSpec{
+		Root:           root,
+		Workspace:      workspace,
+		ReadOnly:       readOnly,
+		IsolateNetwork: sandbox.IsolateNetwork,
+		UID:            uid,
+		GID:            gid,
+		Groups:         extraGroups,
+	})
+	cmd.Args = append([]string{executable, sandboxArg, string(spec), cmd.Path}, cmd.Args...)
+	cmd.Path = executable
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid:     true,
+		Cloneflags:  cloneflags,
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: int(uid), Size: 1}},
+		GidMappings: gidMappings,
+		Credential:  &syscall.Credential{Groups: extraGroups, NoSetGroups: !privileged},
+
+		GidMappingsEnableSetgroups: privileged,
+	}
+	return func() {
+		os.Remove(root)
+	}, nil
+}
+
+// containsID checks if the given list of IDs contains the given ID.
+func containsID(ids []uint32, id uint32) bool {
+	for _, existing := range ids {
+		if existing == id {
+			return true
+		}
+	}
+	return false
+}
+
+// userNamespaceSettings are the sysctls that disable unprivileged user
+// namespaces and the values that disable them.
+var userNamespaceSettings = [][2]string{
+	{"/proc/sys/kernel/unprivileged_userns_clone", "0"},
+	{"/proc/sys/user/max_user_namespaces", "0"},
+	{"/proc/sys/kernel/apparmor_restrict_unprivileged_userns", "1"},
+}
+
+// sandboxStartError explains why starting the sandbox failed if it's because
+// unprivileged user namespaces are not available.
+func sandboxStartError(err error) error {
+	// Creating the namespaces fails with these errors, other errors are e.g.
+	// from executing the gh-deployer binary.
+	if !errors.Is(err, syscall.EPERM) && !errors.Is(err, syscall.EINVAL) && !errors.Is(err, syscall.ENOSPC) {
+		return fmt.Errorf("failed to start sandbox: %v", err)
+	}
+	for _, setting := range userNamespaceSettings {
+		dat, readErr := ioutil.ReadFile(setting[0])
+		if readErr == nil && strings.TrimSpace(string(dat)) == setting[1] {
+			return fmt.Errorf("unprivileged user namespaces are not available (%s is %s), so the sandbox can't be used: %v", setting[0], setting[1], err)
+		}
+	}
+	return fmt.Errorf("failed to create sandbox namespaces (are unprivileged user namespaces available?): %v", err)
+}
+
+// runSandbox sets up the sandbox in the namespaces created by the deployer and
+// runs the command in it. The sandbox process is the init process of the PID
+// namespace, so it waits until the command exits and returns its exit status.
+func runSandbox(specJSON, path string, args []string) int {
+	var spec sandboxSpec
+	err := json.Unmarshal([]byte(specJSON), &spec)
+	if err == nil {
+		err = spec.setup()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gh-deployer: failed to set up sandbox:", err)
+		return exitSetupFailed
+	}
+
+	gidMappings := []syscall.SysProcIDMap{{ContainerID: int(spec.GID), HostID: 0, Size: 1}}
+	for _, group := range spec.Groups {
+		gidMappings = append(gidMappings, syscall.SysProcIDMap{ContainerID: int(group), HostID: int(group), Size: 1})
+	}
+	cmd := &exec.Cmd{
+		Path:   path,
+		Args:   args,
+		Env:    os.Environ(),
+		Stdin:  os.Stdin,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+		SysProcAttr: &syscall.SysProcAttr{
+			Cloneflags:  syscall.CLONE_NEWUSER,
+			UidMappings: []syscall.SysProcIDMap{{ContainerID: int(spec.UID), HostID: 0, Size: 1}},
+			GidMappings: gidMappings,
+		},
+	}
+	err = cmd.Start()
+	if os.IsNotExist(err) {
+		fmt.Fprintln(os.Stderr, "gh-deployer:", err)
+		return 127
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, "gh-deployer:", err)
+		return 126
+	}
+
+	// Orphaned processes in the sandbox are reparented to this process, so
+	// wait for all of them, but stop when the command itself exits.
+	for {
+		var status syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &status, 0, nil)
+		if err == syscall.EINTR {
+			continue
+		} else if err != nil {
+			fmt.Fprintln(os.Stderr, "gh-deployer:", err)
+			return 1
+		} else if pid != cmd.Process.Pid {
+			continue
+		} else if status.Signaled() {
+			return 128 + int(status.Signal())
+		}
+		return status.ExitStatus()
+	}
+}
+
+// setup builds the root filesystem of the sandbox in a tmpfs, switches to it
+// and changes back to the original working directory inside it.
+func (spec sandboxSpec) setup() error {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	// Don't propagate any of the mounts back to the host.
+	err = unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, "")
+	if err != nil {
+		return fmt.Errorf("failed to make mounts private: %v", err)
+	}
+	root := spec.Root
+	err = mountNew("tmpfs", root, unix.MS_NOSUID|unix.MS_NODEV, "mode=0755")
+	if err == nil {
+		err = spec.setupDev()
+	}
+	if err == nil {
+		err = mountNew("proc", filepath.Join(root, "proc"), unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, "")
+	}
+	if err == nil {
+		err = mountNew("tmpfs", filepath.Join(root, "tmp"), unix.MS_NOSUID|unix.MS_NODEV, "mode=1777")
+	}
+	for _, path := range spec.ReadOnly {
+		if err != nil {
+			break
+		}
+		err = bindMount(path, filepath.Join(root, path), true)
+	}
+	if err == nil {
+		err = bindMount(spec.Workspace, filepath.Join(root, spec.Workspace), false)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = os.Chdir(root); err != nil {
+		return err
+	} else if err = unix.PivotRoot(".", "."); err != nil {
+		return fmt.Errorf("failed to change root: %v", err)
+	} else if err = unix.Unmount(".", unix.MNT_DETACH); err != nil {
+		return fmt.Errorf("failed to unmount host root: %v", err)
+	}
+	err = unix.Mount("", "/", "", unix.MS_REMOUNT|unix.MS_BIND|unix.MS_RDONLY|unix.MS_NOSUID|unix.MS_NODEV, "")
+	if err != nil {
+		return fmt.Errorf("failed to make root read-only: %v", err)
+	} else if err = os.Chdir(cwd); err != nil {
+		return err
+	} else if spec.IsolateNetwork {
+		return setLoopbackUp()
+	}
+	return nil
+}
+
+// devices are the device nodes from the host that are available in the sandbox.
+var devices = []string{"null", "zero", "full", "random", "urandom", "tty"}
+
+// setupDev creates /dev in the sandbox root with the basic device nodes.
+func (spec sandboxSpec) setupDev() error {
+	dev := filepath.Join(spec.Root, "dev")
+	err := mountNew("tmpfs", dev, unix.MS_NOSUID|unix.MS_NOEXEC, "mode=0755")
+	if err != nil {
+		return err
+	}
+	for _, device := range devices {
+		if err = bindMount(filepath.Join("/dev", device), filepath.Join(dev, device), false); err != nil {
+			return err
+		}
+	}
+	links := map[string]string{
+		"fd":     "/proc/self/fd",
+		"stdin":  "/proc/self/fd/0",
+		"stdout": "/proc/self/fd/1",
+		"stderr": "/proc/self/fd/2",
+	}
+	for name, target := range links {
+		if err = os.Symlink(target, filepath.Join(dev, name)); err != nil {
+			return err
+		}
+	}
+	return mountNew("tmpfs", filepath.Join(dev, "shm"), unix.MS_NOSUID|unix.MS_NODEV, "mode=1777")
+}
+
+// mountNew creates a directory and mounts a new filesystem of the given type there.
+func mountNew(fsType, target string, flags uintptr, data string) error {
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return err
+	} else if err = unix.Mount(fsType, target, fsType, flags, data); err != nil {
+		return fmt.Errorf("failed to mount %s at %s: %v", fsType, target, err)
+	}
+	return nil
+}
+
+// statfsFlags maps the statfs flags that can't be cleared when remounting a
+// bind mount in a user namespace to the corresponding mount flags.
+var statfsFlags = map[int64]uintptr{
+	0x0002: unix.MS_NOSUID,
+	0x0004: unix.MS_NODEV,
+	0x0008: unix.MS_NOEXEC,
+	0x0400: unix.MS_NOATIME,
+	0x0800: unix.MS_NODIRATIME,
+	0x1000: unix.MS_RELATIME,
+}
+
+// bindMount makes a host path available at the given path inside the sandbox
+// root. Paths that don't exist on the host are skipped and symlinks are copied
+// instead of mounting their target.
+func bindMount(source, target string, readOnly bool) error {
+	info, err := os.Lstat(source)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	} else if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		link, err := os.Readlink(source)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(link, target)
+	} else if info.IsDir() {
+		err = os.MkdirAll(target, 0755)
+	} else {
+		var file *os.File
+		file, err = os.OpenFile(target, os.O_CREATE|os.O_WRONLY, 0644)
+		if err == nil {
+			file.Close()
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	err = unix.Mount(source, target, "", unix.MS_BIND|unix.MS_REC, "")
+	if err != nil {
+		return fmt.Errorf("failed to bind mount %s: %v", source, err)
+	} else if !readOnly {
+		return nil
+	}
+	var stat unix.Statfs_t
+	if err = unix.Statfs(target, &stat); err != nil {
+		return err
+	}
+	flags := uintptr(unix.MS_BIND | unix.MS_REMOUNT | unix.MS_RDONLY)
+	for statFlag, mountFlag := range statfsFlags {
+		if stat.Flags&statFlag != 0 {
+			flags |= mountFlag
+		}
+	}
+	err = unix.Mount("", target, "", flags, "")
+	if err != nil {
+		return fmt.Errorf("failed to make %s read-only: %v", source, err)
+	}
+	return nil
+}
+
+// setLoopbackUp brings up the loopback interface of a new network namespace.
+func setLoopbackUp() error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	// struct ifreq: the interface name followed by a union, which holds the
+	// interface flags for SIOCGIFFLAGS and SIOCSIFFLAGS.
+	var req [40]byte
+	copy(req[:], "lo")
+	flags := (*uint16)(unsafe.Pointer(&req[unix.IFNAMSIZ]))
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.SIOCGIFFLAGS, uintptr(unsafe.Pointer(&req[0])))
+	if errno == 0 {
+		*flags |= unix.IFF_UP
+		_, _, errno = unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&req[0])))
+	}
+	if errno != 0 {
+		return fmt.Errorf("failed to bring up loopback interface: %v", errno)
+	}
+	return nil
+}
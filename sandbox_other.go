@@ -0,0 +1,40 @@
+// gh-deployer - A simple server that listens for changes on GitHub and deploys projects.
+// Copyright (C) 2017 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+func (sandbox Sandbox) wrapCommand(cmd *exec.Cmd, workspace string, cred *syscall.Credential) (func(), error) {
+	return nil, fmt.Errorf("the sandbox is only supported on Linux")
+}
+
+func sandboxStartError(err error) error {
+	return err
+}
+
+func runSandbox(specJSON, path string, args []string) int {
+	fmt.Fprintln(os.Stderr, "gh-deployer: the sandbox is only supported on Linux")
+	return exitSetupFailed
+}
@@ -0,0 +1,276 @@
+// gh-deployer - A simple server that listens for changes on GitHub and deploys projects.
+// Copyright (C) 2017 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"gopkg.in/yaml.v2"
+)
+
+// DeploySecret is a secret from the server config that can be used in
+// deployments without storing it in the repository.
+type DeploySecret struct {
+	Name string `yaml:"name"`
+	// The file to read the value from. Secrets in the encrypted secrets file
+	// have the value directly instead.
+	File  string `yaml:"file"`
+	Value string `yaml:"value"`
+	// The branches and tags the secret is available to. If both are empty,
+	// the secret is available to all branches and tags.
+	Branches []string `yaml:"branches"`
+	Tags     []string `yaml:"tags"`
+	// Whether or not the secret is available to pull request previews.
+	Previews bool `yaml:"previews"`
+}
+
+// AppliesTo checks if the secret is available to the given job.
+func (secret DeploySecret) AppliesTo(job *Job) bool {
+	if job.IsPullRequest() {
+		return secret.Previews
+	} else if len(secret.Branches) == 0 && len(secret.Tags) == 0 {
+		return true
+	} else if job.Ref.IsTag() {
+		return matchAny(secret.Tags, job.Ref.Name())
+	}
+	return matchAny(secret.Branches, job.Ref.Name())
+}
+
+// GetValue gets the value of the secret, reading it from the file if necessary.
+func (secret DeploySecret) GetValue() (string, error) {
+	if len(secret.File) == 0 {
+		return secret.Value, nil
+	}
+	dat, err := ioutil.ReadFile(secret.File)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(dat), "\r\n"), nil
+}
+
+// getDeploySecrets gets the deploy secrets of the repository of the job,
+// including the ones in the encrypted secrets file.
+func getDeploySecrets(job *Job) ([]DeploySecret, error) {
+	repoConf, _ := config.GetRepository(job.Owner, job.Repo)
+	for _, secret := range repoConf.DeploySecrets {
+		if len(secret.File) == 0 {
+			return nil, fmt.Errorf("deploy secret %s doesn't have a file", secret.Name)
+		}
+	}
+	secrets := repoConf.DeploySecrets
+	if len(repoConf.DeploySecretsFile) > 0 {
+		encrypted, err := readEncryptedSecrets(repoConf.DeploySecretsFile, repoConf.DeploySecretsPassphraseFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", repoConf.DeploySecretsFile, err)
+		}
+		secrets = append(secrets, encrypted...)
+	}
+	return secrets, nil
+}
+
+// readEncryptedSecrets decrypts a symmetrically encrypted OpenPGP file (e.g.
+// from gpg --symmetric) and parses the YAML list of secrets inside it.
+func readEncryptedSecrets(path, passphraseFile string) ([]DeploySecret, error) {
+	passphrase, err := ioutil.ReadFile(passphraseFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read passphrase: %v", err)
+	}
+	passphrase = bytes.TrimRight(passphrase, "\r\n")
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var reader io.Reader = file
+	if block, err := armor.Decode(file); err == nil {
+		reader = block.Body
+	} else if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	prompted := false
+	message, err := openpgp.ReadMessage(reader, nil, func(keys []openpgp.Key, symmetric bool) ([]byte, error) {
+		if prompted {
+			return nil, fmt.Errorf("incorrect passphrase")
+		}
+		prompted = true
+		return passphrase, nil
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	dat, err := ioutil.ReadAll(message.UnverifiedBody)
+	if err != nil {
+		return nil, err
+	}
+	var secrets []DeploySecret
+	err = yaml.Unmarshal(dat, &secrets)
+	return secrets, err
+}
+
+// references checks if the given command refers to the variable with $NAME or ${NAME}.
+func references(command, name string) bool {
+	if strings.Contains(command, "${"+name+"}") {
+		return true
+	}
+	for start := 0; ; {
+		index := strings.Index(command[start:], "$"+name)
+		if index < 0 {
+			return false
+		}
+		end := start + index + len(name) + 1
+		if end >= len(command) || !isNameChar(command[end], false) {
+			return true
+		}
+		start = end
+	}
+}
+
+// References checks if the steps that the runner config will run on its branch
+// refer to the given variable in their commands, conditions or environment
+// variables, or if the variable is explicitly listed in the secrets field.
+func (rconf RunnerConfig) References(name string) bool {
+	for _, secret := range rconf.Secrets {
+		if secret == name {
+			return true
+		}
+	}
+	steps := rconf.Steps
+	if len(rconf.Jobs) > 0 {
+		steps = nil
+		for _, job := range rconf.Jobs {
+			steps = append(steps, job.Steps...)
+		}
+	}
+	for _, step := range steps {
+		if !step.RunsOn(rconf.Branch) {
+			continue
+		} else if references(step.Run, name) || references(step.Condition, name) {
+			return true
+		}
+		for _, variable := range step.Environment {
+			if references(variable, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// injectSecrets adds the deploy secrets the runner config refers to into its
+// environment and marks their values to be masked in the output.
+func injectSecrets(job *Job, rconf *RunnerConfig) error {
+	secrets, err := getDeploySecrets(job)
+	if err != nil {
+		return err
+	}
+	injected := make(map[string]bool)
+	for _, secret := range secrets {
+		if injected[secret.Name] || !secret.AppliesTo(job) || !rconf.References(secret.Name) {
+			continue
+		}
+		value, err := secret.GetValue()
+		if err != nil {
+			return fmt.Errorf("failed to read deploy secret %s: %v", secret.Name, err)
+		}
+		rconf.Environment = append(rconf.Environment, secret.Name+"="+value)
+		rconf.Masked = append(rconf.Masked, value)
+		injected[secret.Name] = true
+	}
+	return nil
+}
+
+// newMasker creates a replacer that replaces each line of the given values with asterisks.
+func newMasker(values []string) *strings.Replacer {
+	var lines []string
+	for _, value := range values {
+		for _, line := range strings.Split(value, "\n") {
+			if line = strings.TrimSpace(line); len(line) > 0 {
+				lines = append(lines, line)
+			}
+		}
+	}
+	// Replace longer values first in case one value contains another.
+	sort.Slice(lines, func(i, j int) bool {
+		return len(lines[i]) > len(lines[j])
+	})
+	pairs := make([]string, 0, len(lines)*2)
+	for _, line := range lines {
+		pairs = append(pairs, line, "***")
+	}
+	return strings.NewReplacer(pairs...)
+}
+
+// maskResult masks secret values in the error messages of a deployment result.
+func maskResult(result DeployResult, masker *strings.Replacer) DeployResult {
+	result.Reason = masker.Replace(result.Reason)
+	for i := range result.Steps {
+		result.Steps[i].Error = masker.Replace(result.Steps[i].Error)
+	}
+	for name, jobResult := range result.Jobs {
+		result.Jobs[name] = maskResult(jobResult, masker)
+	}
+	return result
+}
+
+// maxMaskBuffer is the maximum length of an incomplete line buffered by maskWriter.
+const maxMaskBuffer = 64 * 1024
+
+// maskWriter masks secret values in everything written through it. Output is
+// buffered until the end of each line, so that values split into multiple
+// writes are masked too.
+type maskWriter struct {
+	lock   sync.Mutex
+	target io.Writer
+	masker *strings.Replacer
+	buf    []byte
+}
+
+// Write implements io.Writer
+func (mw *maskWriter) Write(data []byte) (int, error) {
+	mw.lock.Lock()
+	defer mw.lock.Unlock()
+	mw.buf = append(mw.buf, data...)
+	end := bytes.LastIndexAny(mw.buf, "\r\n")
+	if end >= 0 {
+		mw.masker.WriteString(mw.target, string(mw.buf[:end+1]))
+		mw.buf = mw.buf[end+1:]
+	}
+	if len(mw.buf) > maxMaskBuffer {
+		mw.masker.WriteString(mw.target, string(mw.buf))
+		mw.buf = nil
+	}
+	return len(data), nil
+}
+
+// Flush writes the last line even if it's incomplete.
+func (mw *maskWriter) Flush() {
+	mw.lock.Lock()
+	defer mw.lock.Unlock()
+	mw.masker.WriteString(mw.target, string(mw.buf))
+	mw.buf = nil
+}
@@ -0,0 +1,158 @@
+// gh-deployer - A simple server that listens for changes on GitHub and deploys projects.
+// Copyright (C) 2017 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestReferences(t *testing.T) {
+	tests := []struct {
+		command string
+		ok      bool
+	}{
+		{"echo $KEY", true},
+		{"echo ${KEY}", true},
+		{"echo x$KEY.", true},
+		{"echo \"$KEY\"", true},
+		{"echo $KEY_SUFFIX", false},
+		{"echo $KEY2", false},
+		{"echo ${KEY_SUFFIX}", false},
+		{"echo $PREFIX_KEY", false},
+		{"echo $KEY_SUFFIX $KEY", true},
+		{"echo KEY", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if ok := references(test.command, "KEY"); ok != test.ok {
+			t.Errorf("references(%q, KEY) = %t, want %t", test.command, ok, test.ok)
+		}
+	}
+}
+
+func TestRunnerConfigReferences(t *testing.T) {
+	rconf := RunnerConfig{
+		Branch:  "feature/x",
+		Secrets: []string{"LISTED"},
+		Steps: []Step{
+			{Run: "make deploy", Condition: "test -n $IN_CONDITION", Environment: []string{"TOKEN=$IN_ENV"}},
+			{Run: "deploy $PROD_KEY", Only: []string{"master"}},
+			{Run: "deploy $NOT_FEATURE", Except: []string{"feature/*"}},
+		},
+		Teardown: []Step{{Run: "teardown $IN_TEARDOWN"}},
+	}
+	for name, ok := range map[string]bool{
+		"LISTED":       true,
+		"IN_CONDITION": true,
+		"IN_ENV":       true,
+		"PROD_KEY":     false,
+		"NOT_FEATURE":  false,
+		"IN_TEARDOWN":  false,
+	} {
+		if rconf.References(name) != ok {
+			t.Errorf("References(%s) = %t, want %t", name, !ok, ok)
+		}
+	}
+	rconf.Branch = "master"
+	if !rconf.References("PROD_KEY") {
+		t.Error("References(PROD_KEY) = false on master")
+	}
+}
+
+var testSecrets = []string{
+	"hunter2",
+	"hunter2-extended",
+	"-----BEGIN KEY-----\nAAAA\nBBBB\n-----END KEY-----\n",
+}
+
+func TestMasker(t *testing.T) {
+	masker := newMasker(testSecrets)
+	tests := []struct {
+		input, output string
+	}{
+		{"password: hunter2", "password: ***"},
+		{"password: hunter2-extended!", "password: ***!"},
+		{"hunter2hunter2", "******"},
+		{"key:\n-----BEGIN KEY-----\nAAAA\nBBBB\n-----END KEY-----\n", "key:\n***\n***\n***\n***\n"},
+		{"only part: AAAA", "only part: ***"},
+		{"hunter", "hunter"},
+	}
+	for _, test := range tests {
+		if output := masker.Replace(test.input); output != test.output {
+			t.Errorf("masking %q = %q, want %q", test.input, output, test.output)
+		}
+	}
+}
+
+func TestMaskWriter(t *testing.T) {
+	tests := []struct {
+		writes []string
+		// The output before and after flushing.
+		written, flushed string
+	}{
+		{[]string{"password: hun", "ter2\nnext"}, "password: ***\n", "password: ***\nnext"},
+		{[]string{"a hunter2-ext", "ended b\r\n"}, "a *** b\r\n", "a *** b\r\n"},
+		{[]string{"-----BEGIN KEY-----\nAA", "AA\nBB", "BB\n"}, "***\n***\n***\n", "***\n***\n***\n"},
+		{[]string{"trailing hunter2"}, "", "trailing ***"},
+	}
+	for _, test := range tests {
+		var output bytes.Buffer
+		writer := &maskWriter{target: &output, masker: newMasker(testSecrets)}
+		for _, data := range test.writes {
+			if n, err := writer.Write([]byte(data)); n != len(data) || err != nil {
+				t.Errorf("Write(%q) = %d, %v", data, n, err)
+			}
+		}
+		if output.String() != test.written {
+			t.Errorf("writing %q wrote %q, want %q", test.writes, output.String(), test.written)
+		}
+		writer.Flush()
+		if output.String() != test.flushed {
+			t.Errorf("writing %q and flushing wrote %q, want %q", test.writes, output.String(), test.flushed)
+		}
+	}
+}
+
+func TestMaskWriterLongLine(t *testing.T) {
+	var output bytes.Buffer
+	writer := &maskWriter{target: &output, masker: newMasker(testSecrets)}
+	writer.Write([]byte(strings.Repeat("x", maxMaskBuffer) + "hunter2"))
+	if output.Len() == 0 {
+		t.Error("line longer than the buffer limit wasn't written")
+	} else if strings.Contains(output.String(), "hunter2") {
+		t.Error("secret in a long line wasn't masked")
+	}
+}
+
+func TestMaskResult(t *testing.T) {
+	result := maskResult(DeployResult{
+		Reason: "step failed: hunter2",
+		Steps:  []StepResult{{Command: "login $PASSWORD", Error: "bad password hunter2"}},
+		Jobs: map[string]DeployResult{
+			"deploy": {Reason: "hunter2-extended", Steps: []StepResult{{Error: "AAAA"}}},
+		},
+	}, newMasker(testSecrets))
+	if result.Reason != "step failed: ***" || result.Steps[0].Error != "bad password ***" {
+		t.Errorf("result wasn't masked: %+v", result)
+	} else if job := result.Jobs["deploy"]; job.Reason != "***" || job.Steps[0].Error != "***" {
+		t.Errorf("job result wasn't masked: %+v", job)
+	} else if result.Steps[0].Command != "login $PASSWORD" {
+		t.Errorf("command was changed: %q", result.Steps[0].Command)
+	}
+}
@@ -21,27 +21,90 @@ import (
 	log "maunium.net/go/maulogger"
 )
 
+var queue = NewQueue()
+
 func startServer() {
+	log.Debugf("Starting %d deployment workers...\n", config.Workers)
+	queue.Start(config.Workers)
+
 	log.Debugln("Initializing webhook receiver...")
-	server := githuuk.NewServer()
-	server.Host = config.Host
-	server.Port = config.Port
-	server.Secret = config.Secret
-	server.Path = config.Path
+	server := NewWebhookServer()
 	server.AsyncListenAndServe()
 
 	log.Infof("Listening for webhooks on %s:%d%s\n", server.Host, server.Port, server.Path)
 	for rawEvent := range server.Events {
 		switch evt := rawEvent.(type) {
-		case *githuuk.PushEvent:
+		case *PushEvent:
 			if !evt.Deleted {
-				log.Debugf("%s pushed to %s branch %s\n", evt.Sender.Login, evt.Repository.FullName, evt.Ref.Name())
-				pull(evt.Repository.Owner.Login, evt.Repository.Name, evt.Ref.Name())
-				run(evt.Repository.Owner.Login, evt.Repository.Name, evt.Ref.Name())
+				log.Debugf("%s pushed to %s %s\n", evt.Sender.Login, evt.Repository.FullName, evt.Ref)
+				if !config.IsAllowed(evt.Repository.Owner.Login, evt.Repository.Name, evt.Ref) {
+					log.Warnf("Rejected push to %s %s: repository, branch or tag not allowed\n", evt.Repository.FullName, evt.Ref)
+					continue
+				}
+				queue.Push(&Job{
+					Type:      JobDeploy,
+					Owner:     evt.Repository.Owner.Login,
+					Repo:      evt.Repository.Name,
+					Ref:       evt.Ref,
+					Commit:    evt.After,
+					Before:    evt.Before,
+					Forced:    evt.Forced,
+					EventType: evt.Type,
+					Sender:    evt.Sender.Login,
+					Pusher:    evt.Pusher.Name,
+				})
 			}
+		case *PullRequestEvent:
+			handlePullRequest(evt)
 		case *githuuk.DeleteEvent:
-			log.Debugf("%s deleted branch %s of %s\n", evt.Sender.Login, evt.Ref.Name(), evt.Repository.FullName)
-			remove(evt.Repository.Owner.Login, evt.Repository.Name, evt.Ref.Name())
+			// The ref in delete events is the short name, so add the prefix manually.
+			ref := githuuk.Reference("refs/heads/" + evt.Ref)
+			if evt.RefType == githuuk.ReferenceTypeTag {
+				ref = githuuk.Reference("refs/tags/" + evt.Ref)
+			}
+			log.Debugf("%s deleted %s of %s\n", evt.Sender.Login, ref, evt.Repository.FullName)
+			if !config.IsAllowed(evt.Repository.Owner.Login, evt.Repository.Name, ref) {
+				log.Warnf("Rejected deletion of %s %s: repository, branch or tag not allowed\n", evt.Repository.FullName, ref)
+				continue
+			}
+			queue.Push(&Job{
+				Type:      JobRemove,
+				Owner:     evt.Repository.Owner.Login,
+				Repo:      evt.Repository.Name,
+				Ref:       ref,
+				EventType: evt.Type,
+				Sender:    evt.Sender.Login,
+			})
 		}
 	}
 }
+
+func handlePullRequest(evt *PullRequestEvent) {
+	job := &Job{
+		Owner:       evt.Repository.Owner.Login,
+		Repo:        evt.Repository.Name,
+		Ref:         evt.PullRequest.Ref(),
+		PullRequest: evt.PullRequest.Number,
+		Commit:      evt.PullRequest.Head.SHA,
+		Before:      evt.Before,
+		EventType:   evt.Type,
+		Sender:      evt.Sender.Login,
+	}
+	switch evt.Action {
+	case "opened", "reopened", "synchronize":
+		job.Type = JobDeploy
+	case "closed":
+		job.Type = JobRemove
+	default:
+		return
+	}
+	log.Debugf("%s %s pull request #%d of %s\n", evt.Sender.Login, evt.Action, evt.PullRequest.Number, evt.Repository.FullName)
+	if _, ok := config.GetRepository(job.Owner, job.Repo); !ok {
+		log.Warnf("Rejected pull request #%d of %s: repository not allowed\n", evt.PullRequest.Number, evt.Repository.FullName)
+		return
+	} else if !config.IsPreviewAllowed(job.Owner, job.Repo) {
+		log.Debugf("Ignoring pull request #%d of %s: previews not enabled\n", evt.PullRequest.Number, evt.Repository.FullName)
+		return
+	}
+	queue.Push(job)
+}
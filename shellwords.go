@@ -0,0 +1,142 @@
+// gh-deployer - A simple server that listens for changes on GitHub and deploys projects.
+// Copyright (C) 2017 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// envLookup creates a variable lookup function from a list of KEY=value
+// pairs. Later pairs override earlier ones like in exec.Cmd.Env.
+func envLookup(env []string) func(string) string {
+	vars := make(map[string]string, len(env))
+	for _, pair := range env {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) == 2 {
+			vars[parts[0]] = parts[1]
+		}
+	}
+	return func(name string) string {
+		return vars[name]
+	}
+}
+
+func isNameChar(char byte, first bool) bool {
+	return char == '_' || (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z') || (!first && char >= '0' && char <= '9')
+}
+
+// splitWords splits a command into words like a POSIX shell would. Single and
+// double quotes and backslash escapes are supported, and $VAR and ${VAR} are
+// expanded using the given lookup function outside single quotes. Unlike in a
+// shell, the results of variable expansion are never split into multiple words.
+func splitWords(command string, lookup func(string) string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote byte
+
+	for i := 0; i < len(command); i++ {
+		char := command[i]
+		switch {
+		case quote == '\'':
+			if char == '\'' {
+				quote = 0
+			} else {
+				word.WriteByte(char)
+			}
+		case char == '\\':
+			i++
+			if i >= len(command) {
+				return nil, fmt.Errorf("unexpected end of command after backslash")
+			}
+			next := command[i]
+			if next == '\n' {
+				// Escaped newlines are line continuations.
+				continue
+			} else if quote == '"' && !strings.ContainsRune("$`\"\\", rune(next)) {
+				word.WriteByte(char)
+			}
+			word.WriteByte(next)
+			inWord = true
+		case char == '$':
+			value, length, err := expandVariable(command[i+1:], lookup)
+			if err != nil {
+				return nil, err
+			}
+			word.WriteString(value)
+			i += length
+			inWord = inWord || length == 0 || len(value) > 0
+		case quote == '"':
+			if char == '"' {
+				quote = 0
+			} else {
+				word.WriteByte(char)
+			}
+		case char == '\'' || char == '"':
+			quote = char
+			inWord = true
+		case char == ' ' || char == '\t' || char == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteByte(char)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// expandVariable expands the variable reference at the start of the given
+// string (which is the part after the $ sign). It returns the value and the
+// number of bytes the reference took. If there's no valid variable name, the
+// length is zero and the dollar sign is returned as-is.
+func expandVariable(str string, lookup func(string) string) (string, int, error) {
+	if strings.HasPrefix(str, "{") {
+		end := strings.IndexByte(str, '}')
+		if end < 0 {
+			return "", 0, fmt.Errorf("unterminated ${")
+		}
+		name := str[1:end]
+		if len(name) == 0 || !isNameChar(name[0], true) {
+			return "", 0, fmt.Errorf("bad variable name ${%s}", name)
+		}
+		for i := 1; i < len(name); i++ {
+			if !isNameChar(name[i], false) {
+				return "", 0, fmt.Errorf("bad variable name ${%s}", name)
+			}
+		}
+		return lookup(name), end + 1, nil
+	}
+	length := 0
+	for length < len(str) && isNameChar(str[length], length == 0) {
+		length++
+	}
+	if length == 0 {
+		return "$", 0, nil
+	}
+	return lookup(str[:length]), length, nil
+}
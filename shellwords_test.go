@@ -0,0 +1,71 @@
+// gh-deployer - A simple server that listens for changes on GitHub and deploys projects.
+// Copyright (C) 2017 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitWords(t *testing.T) {
+	lookup := envLookup([]string{"NAME=world", "SPACED=a b", "EMPTY=", "NAME=override"})
+	tests := []struct {
+		command string
+		words   []string
+	}{
+		{"echo hello  world", []string{"echo", "hello", "world"}},
+		{" \techo\nhi ", []string{"echo", "hi"}},
+		{`echo 'single $NAME "quoted"'`, []string{"echo", `single $NAME "quoted"`}},
+		{`echo "double 'quoted' $NAME"`, []string{"echo", "double 'quoted' override"}},
+		{`echo a"b"'c'd`, []string{"echo", "abcd"}},
+		{`echo '' ""`, []string{"echo", "", ""}},
+		{`echo a\ b \$NAME \\`, []string{"echo", "a b", "$NAME", `\`}},
+		{`echo "\$NAME \" \\ \n"`, []string{"echo", `$NAME " \ \n`}},
+		{`echo 'a\nb'`, []string{"echo", `a\nb`}},
+		{"echo a\\\nb", []string{"echo", "ab"}},
+		{"echo $NAME ${NAME}s x${NAME}y", []string{"echo", "override", "overrides", "xoverridey"}},
+		{"echo $SPACED", []string{"echo", "a b"}},
+		{"echo $EMPTY $UNSET end", []string{"echo", "end"}},
+		{`echo "$EMPTY"`, []string{"echo", ""}},
+		{"echo $ a$ $1x", []string{"echo", "$", "a$", "$1x"}},
+		{"", nil},
+	}
+	for _, test := range tests {
+		words, err := splitWords(test.command, lookup)
+		if err != nil {
+			t.Errorf("splitWords(%q) returned error: %v", test.command, err)
+		} else if !reflect.DeepEqual(words, test.words) {
+			t.Errorf("splitWords(%q) = %q, want %q", test.command, words, test.words)
+		}
+	}
+}
+
+func TestSplitWordsErrors(t *testing.T) {
+	for _, command := range []string{
+		`echo 'unterminated`,
+		`echo "unterminated`,
+		`echo trailing\`,
+		"echo ${UNTERMINATED",
+		"echo ${}",
+		"echo ${1A}",
+		"echo ${A-B}",
+	} {
+		if words, err := splitWords(command, envLookup(nil)); err == nil {
+			t.Errorf("splitWords(%q) = %q, want error", command, words)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+// gh-deployer - A simple server that listens for changes on GitHub and deploys projects.
+// Copyright (C) 2017 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"net/http"
+
+	"maunium.net/go/githuuk"
+	log "maunium.net/go/maulogger"
+)
+
+// WebhookServer is a githuuk server that verifies each webhook against the
+// secrets of the repository the webhook is for instead of a single secret.
+type WebhookServer struct {
+	*githuuk.Server
+}
+
+// NewWebhookServer creates a webhook server using the settings in the config.
+func NewWebhookServer() *WebhookServer {
+	server := &WebhookServer{githuuk.NewServer()}
+	server.Host = config.Host
+	server.Port = config.Port
+	server.Path = config.Path
+	return server
+}
+
+// AsyncListenAndServe runs the server inside a Goroutine and panics if an error occurs.
+func (server *WebhookServer) AsyncListenAndServe() {
+	go func() {
+		err := http.ListenAndServe(fmt.Sprintf("%s:%d", server.Host, server.Port), server)
+		if err != nil {
+			panic(err)
+		}
+	}()
+}
+
+// CheckSignature checks that the request is from GitHub and signed with one
+// of the secrets of the repository. The SHA-256 signature is used if present,
+// otherwise the legacy SHA-1 signature is checked unless SHA-256 is required.
+func (server *WebhookServer) CheckSignature(w http.ResponseWriter, r *http.Request, body []byte) bool {
+	var payload struct {
+		Repository struct {
+			FullName string `json:"full_name"`
+		} `json:"repository"`
+	}
+	err := json.Unmarshal(body, &payload)
+	if err != nil {
+		http.Error(w, "Bad Request - Invalid JSON body", http.StatusBadRequest)
+		return false
+	}
+
+	secrets := config.GetSecrets(payload.Repository.FullName)
+	if len(secrets) == 0 {
+		return true
+	}
+
+	header := "X-Hub-Signature-256"
+	algorithm, hashFunc := "sha256", sha256.New
+	sig := r.Header.Get(header)
+	if len(sig) == 0 {
+		if config.RequireSHA256 {
+			log.Warnf("Rejected webhook for %s from %s: missing SHA-256 signature\n", payload.Repository.FullName, r.RemoteAddr)
+			http.Error(w, "Forbidden - Missing X-Hub-Signature-256", http.StatusForbidden)
+			return false
+		}
+		header = "X-Hub-Signature"
+		algorithm, hashFunc = "sha1", sha1.New
+		sig = r.Header.Get(header)
+		if len(sig) == 0 {
+			http.Error(w, "Forbidden - Missing X-Hub-Signature", http.StatusForbidden)
+			return false
+		}
+	}
+	for _, secret := range secrets {
+		if hmac.Equal([]byte(signBody(algorithm, hashFunc, secret, body)), []byte(sig)) {
+			return true
+		}
+	}
+	log.Warnf("Rejected webhook for %s from %s: signature verification failed\n", payload.Repository.FullName, r.RemoteAddr)
+	http.Error(w, fmt.Sprintf("Forbidden - %s verification failed", header), http.StatusForbidden)
+	return false
+}
+
+func signBody(algorithm string, hashFunc func() hash.Hash, secret string, body []byte) string {
+	mac := hmac.New(hashFunc, []byte(secret))
+	mac.Write(body)
+	return fmt.Sprintf("%s=%s", algorithm, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (server *WebhookServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if r.Method == "GET" && r.URL.Path == server.PingPath {
+		w.Write([]byte("OK"))
+		return
+	} else if r.URL.Path != server.Path {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	} else if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	eventType := githuuk.EventType(r.Header.Get("X-GitHub-Event"))
+	if eventType == "" {
+		http.Error(w, "Bad Request - Missing X-GitHub-Event Header", http.StatusBadRequest)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !server.CheckSignature(w, r, body) {
+		return
+	}
+
+	event, status, err := server.ParseEvent(eventType, body)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	server.Events <- event
+
+	w.Header().Set("Server", fmt.Sprintf("githuuk/%s", githuuk.Version))
+	w.Write([]byte("{}"))
+}
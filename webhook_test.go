@@ -0,0 +1,129 @@
+// gh-deployer - A simple server that listens for changes on GitHub and deploys projects.
+// Copyright (C) 2017 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func sign(hashFunc func() hash.Hash, prefix, secret string, body []byte) string {
+	mac := hmac.New(hashFunc, []byte(secret))
+	mac.Write(body)
+	return prefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+func checkSignature(body []byte, headers map[string]string) (bool, int) {
+	r := httptest.NewRequest("POST", "/webhook", nil)
+	for key, value := range headers {
+		r.Header.Set(key, value)
+	}
+	w := httptest.NewRecorder()
+	ok := (&WebhookServer{}).CheckSignature(w, r, body)
+	return ok, w.Code
+}
+
+func TestCheckSignature(t *testing.T) {
+	defer func(orig Config) { config = orig }(config)
+	config = Config{
+		Secret:  "global",
+		Secrets: []string{"global-next"},
+		Repositories: map[string]RepositoryConfig{
+			"tulir/rotating": {Secret: "old", Secrets: []string{"new"}},
+			"tulir/global":   {},
+		},
+	}
+	rotating := []byte(`{"repository": {"full_name": "tulir/rotating"}}`)
+	global := []byte(`{"repository": {"full_name": "tulir/global"}}`)
+
+	tests := []struct {
+		name    string
+		body    []byte
+		headers map[string]string
+		ok      bool
+	}{
+		{"sha256", rotating, map[string]string{
+			"X-Hub-Signature-256": sign(sha256.New, "sha256=", "old", rotating),
+		}, true},
+		{"sha256 rotated secret", rotating, map[string]string{
+			"X-Hub-Signature-256": sign(sha256.New, "sha256=", "new", rotating),
+		}, true},
+		{"sha256 global secret not accepted for repository with own secrets", rotating, map[string]string{
+			"X-Hub-Signature-256": sign(sha256.New, "sha256=", "global", rotating),
+		}, false},
+		{"sha256 global secret", global, map[string]string{
+			"X-Hub-Signature-256": sign(sha256.New, "sha256=", "global", global),
+		}, true},
+		{"sha256 rotated global secret", global, map[string]string{
+			"X-Hub-Signature-256": sign(sha256.New, "sha256=", "global-next", global),
+		}, true},
+		{"sha1 fallback", rotating, map[string]string{
+			"X-Hub-Signature": sign(sha1.New, "sha1=", "new", rotating),
+		}, true},
+		{"sha256 preferred over sha1", rotating, map[string]string{
+			"X-Hub-Signature-256": "sha256=0000",
+			"X-Hub-Signature":     sign(sha1.New, "sha1=", "old", rotating),
+		}, false},
+		{"sha1 signature in sha256 header", rotating, map[string]string{
+			"X-Hub-Signature-256": sign(sha1.New, "sha1=", "old", rotating),
+		}, false},
+		{"wrong body", rotating, map[string]string{
+			"X-Hub-Signature-256": sign(sha256.New, "sha256=", "old", global),
+		}, false},
+		{"missing signature", rotating, map[string]string{}, false},
+	}
+	for _, test := range tests {
+		ok, code := checkSignature(test.body, test.headers)
+		if ok != test.ok {
+			t.Errorf("%s: got %t, want %t", test.name, ok, test.ok)
+		} else if !ok && code != http.StatusForbidden {
+			t.Errorf("%s: got status %d, want %d", test.name, code, http.StatusForbidden)
+		}
+	}
+}
+
+func TestCheckSignatureRequireSHA256(t *testing.T) {
+	defer func(orig Config) { config = orig }(config)
+	config = Config{Secret: "secret", RequireSHA256: true}
+	body := []byte(`{"repository": {"full_name": "tulir/gh-deployer"}}`)
+
+	ok, code := checkSignature(body, map[string]string{"X-Hub-Signature": sign(sha1.New, "sha1=", "secret", body)})
+	if ok || code != http.StatusForbidden {
+		t.Errorf("SHA-1 signature accepted with require-sha256 (status %d)", code)
+	}
+	ok, _ = checkSignature(body, map[string]string{"X-Hub-Signature-256": sign(sha256.New, "sha256=", "secret", body)})
+	if !ok {
+		t.Error("SHA-256 signature rejected with require-sha256")
+	}
+}
+
+func TestCheckSignatureNoSecrets(t *testing.T) {
+	defer func(orig Config) { config = orig }(config)
+	config = Config{}
+	if ok, _ := checkSignature([]byte(`{"repository": {"full_name": "tulir/gh-deployer"}}`), nil); !ok {
+		t.Error("unsigned webhook rejected without any secrets configured")
+	}
+	if ok, code := checkSignature([]byte(`not json`), nil); ok || code != http.StatusBadRequest {
+		t.Errorf("invalid body accepted (status %d)", code)
+	}
+}
@@ -0,0 +1,77 @@
+// gh-deployer - A simple server that listens for changes on GitHub and deploys projects.
+// Copyright (C) 2017 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"syscall"
+)
+
+// deployerFiles are the files gh-deployer writes into workspaces. They stay
+// owned by the deployer when the workspace is given to the run-as user.
+var deployerFiles = map[string]bool{
+	".git":         true,
+	".stdout":      true,
+	".stderr":      true,
+	".result":      true,
+	".environment": true,
+}
+
+// createStateFile creates a file that the deployer writes into a workspace,
+// replacing the old one. The old file is removed first and the new one is
+// created exclusively without following symlinks, so that deployment commands
+// can't redirect the write by planting a symlink or a hard link.
+func createStateFile(path string, perm os.FileMode) (*os.File, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL|syscall.O_NOFOLLOW, perm)
+}
+
+// writeStateFile writes a file into a workspace with createStateFile.
+func writeStateFile(path string, data []byte, perm os.FileMode) error {
+	file, err := createStateFile(path, perm)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// readStateFile reads a file that the deployer wrote into a workspace. Files
+// that the deployer didn't create itself are refused.
+func readStateFile(path string) ([]byte, error) {
+	file, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !info.Mode().IsRegular() || (ok && (int(stat.Uid) != os.Geteuid() || stat.Nlink != 1)) {
+		return nil, fmt.Errorf("%s was not created by gh-deployer", path)
+	}
+	return ioutil.ReadAll(file)
+}
@@ -0,0 +1,269 @@
+// gh-deployer - A simple server that listens for changes on GitHub and deploys projects.
+// Copyright (C) 2017 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+	"gopkg.in/src-d/go-billy.v4"
+	"gopkg.in/src-d/go-billy.v4/osfs"
+)
+
+// safeFS is the filesystem the deployer updates worktrees through. Workspaces
+// given to a run-as user can contain symlinks planted by deployment commands,
+// so all writes are done relative to directory file descriptors that are
+// opened one path component at a time without following symlinks. Writing
+// to a path that goes through a symlink fails instead of leaving the workspace.
+type safeFS struct {
+	billy.Filesystem
+	root string
+}
+
+// newWorktreeFS creates the filesystem for the worktree in the given directory.
+func newWorktreeFS(root string) billy.Filesystem {
+	return &safeFS{Filesystem: osfs.New(root), root: root}
+}
+
+// safeFile is a file opened by safeFS.
+type safeFile struct {
+	*os.File
+	name string
+}
+
+// Name implements billy.File
+func (file *safeFile) Name() string {
+	return file.name
+}
+
+// Lock implements billy.File
+func (file *safeFile) Lock() error {
+	return unix.Flock(int(file.Fd()), unix.LOCK_EX)
+}
+
+// Unlock implements billy.File
+func (file *safeFile) Unlock() error {
+	return unix.Flock(int(file.Fd()), unix.LOCK_UN)
+}
+
+// splitPath splits a path relative to the root into its components.
+func splitPath(path string) ([]string, error) {
+	path = filepath.Clean(filepath.FromSlash(path))
+	if path == "." || path == string(filepath.Separator) {
+		return nil, nil
+	} else if filepath.IsAbs(path) || path == ".." || strings.HasPrefix(path, ".."+string(filepath.Separator)) {
+		return nil, billy.ErrCrossedBoundary
+	}
+	return strings.Split(path, string(filepath.Separator)), nil
+}
+
+// openDir opens a directory inside the root without following symlinks,
+// optionally creating missing directories on the way.
+func (fs *safeFS) openDir(parts []string, create bool, perm os.FileMode) (int, error) {
+	const flags = unix.O_RDONLY | unix.O_DIRECTORY | unix.O_NOFOLLOW | unix.O_CLOEXEC
+	fd, err := unix.Open(fs.root, flags, 0)
+	if err != nil {
+		return -1, &os.PathError{Op: "open", Path: fs.root, Err: err}
+	}
+	for i, part := range parts {
+		next, err := unix.Openat(fd, part, flags, 0)
+		if err == unix.ENOENT && create {
+			if err = unix.Mkdirat(fd, part, uint32(perm.Perm())); err == nil || err == unix.EEXIST {
+				next, err = unix.Openat(fd, part, flags, 0)
+			}
+		}
+		unix.Close(fd)
+		if err != nil {
+			return -1, &os.PathError{Op: "open", Path: filepath.Join(append([]string{fs.root}, parts[:i+1]...)...), Err: err}
+		}
+		fd = next
+	}
+	return fd, nil
+}
+
+// openParent opens the directory that contains the given path and returns
+// the descriptor of the directory and the name of the path inside it.
+func (fs *safeFS) openParent(path string, create bool) (int, string, error) {
+	parts, err := splitPath(path)
+	if err != nil {
+		return -1, "", err
+	} else if len(parts) == 0 {
+		return -1, "", &os.PathError{Op: "open", Path: fs.root, Err: unix.EINVAL}
+	}
+	fd, err := fs.openDir(parts[:len(parts)-1], create, 0755)
+	return fd, parts[len(parts)-1], err
+}
+
+// Create implements billy.Basic
+func (fs *safeFS) Create(filename string) (billy.File, error) {
+	return fs.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+// OpenFile implements billy.Basic. Files opened only for reading are opened
+// normally, as reads can't modify anything outside the workspace.
+func (fs *safeFS) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) == 0 {
+		return fs.Filesystem.OpenFile(filename, flag, perm)
+	}
+	dir, name, err := fs.openParent(filename, flag&os.O_CREATE != 0)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(dir)
+	fd, err := unix.Openat(dir, name, flag|unix.O_NOFOLLOW|unix.O_CLOEXEC, uint32(perm.Perm()))
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: filepath.Join(fs.root, filename), Err: err}
+	}
+	return &safeFile{File: os.NewFile(uintptr(fd), filepath.Join(fs.root, filename)), name: filename}, nil
+}
+
+// MkdirAll implements billy.Dir
+func (fs *safeFS) MkdirAll(filename string, perm os.FileMode) error {
+	parts, err := splitPath(filename)
+	if err != nil {
+		return err
+	}
+	fd, err := fs.openDir(parts, true, perm)
+	if err == nil {
+		unix.Close(fd)
+	}
+	return err
+}
+
+// Remove implements billy.Basic
+func (fs *safeFS) Remove(filename string) error {
+	dir, name, err := fs.openParent(filename, false)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(dir)
+	err = unix.Unlinkat(dir, name, 0)
+	if err == unix.EISDIR {
+		err = unix.Unlinkat(dir, name, unix.AT_REMOVEDIR)
+	}
+	if err != nil {
+		return &os.PathError{Op: "remove", Path: filepath.Join(fs.root, filename), Err: err}
+	}
+	return nil
+}
+
+// Rename implements billy.Basic
+func (fs *safeFS) Rename(from, to string) error {
+	fromDir, fromName, err := fs.openParent(from, false)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fromDir)
+	toDir, toName, err := fs.openParent(to, true)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(toDir)
+	err = unix.Renameat(fromDir, fromName, toDir, toName)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: filepath.Join(fs.root, from), New: filepath.Join(fs.root, to), Err: err}
+	}
+	return nil
+}
+
+// Symlink implements billy.Symlink
+func (fs *safeFS) Symlink(target, link string) error {
+	dir, name, err := fs.openParent(link, true)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(dir)
+	err = unix.Symlinkat(target, dir, name)
+	if err != nil {
+		return &os.LinkError{Op: "symlink", Old: target, New: filepath.Join(fs.root, link), Err: err}
+	}
+	return nil
+}
+
+// chownWorkspace gives the working tree of a workspace to the given user, so
+// that deployment commands can modify it. The workspace directory itself stays
+// owned by the deployer, but gets the group of the user and the sticky bit, so
+// the user can create files in it but can't replace the files of the deployer,
+// which are left alone, including the git repository. Everything is done
+// through file descriptors opened without following symlinks, and files with
+// other hard links aren't given away, so deployment commands that are still
+// running can't make the deployer change the owner of files outside the workspace.
+func chownWorkspace(dir string, cred *syscall.Credential) error {
+	fd, err := unix.Open(dir, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: dir, Err: err}
+	} else if err = unix.Fchown(fd, -1, int(cred.Gid)); err != nil {
+		unix.Close(fd)
+		return &os.PathError{Op: "chown", Path: dir, Err: err}
+	} else if err = unix.Fchmod(fd, unix.S_ISVTX|0775); err != nil {
+		unix.Close(fd)
+		return &os.PathError{Op: "chmod", Path: dir, Err: err}
+	}
+	return chownDir(fd, dir, int(cred.Uid), int(cred.Gid), true)
+}
+
+// chownDir changes the owner of everything inside the directory with the
+// given descriptor. The descriptor is closed afterwards.
+func chownDir(fd int, path string, uid, gid int, top bool) error {
+	dir := os.NewFile(uintptr(fd), path)
+	defer dir.Close()
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if top && deployerFiles[name] {
+			continue
+		}
+		err = chownEntry(fd, name, filepath.Join(path, name), uid, gid)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chownEntry changes the owner of a single entry in a directory, and of
+// everything inside it if it's a directory.
+func chownEntry(dirFD int, name, path string, uid, gid int) error {
+	fd, err := unix.Openat(dirFD, name, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	isDir := err == nil
+	if err == unix.ENOTDIR || err == unix.ELOOP {
+		fd, err = unix.Openat(dirFD, name, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	}
+	if err == unix.ENOENT {
+		return nil
+	} else if err != nil {
+		return &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	var stat unix.Stat_t
+	err = unix.Fstat(fd, &stat)
+	if err == nil && (int(stat.Uid) != uid || int(stat.Gid) != gid) && (isDir || stat.Nlink == 1) {
+		err = unix.Fchownat(fd, "", uid, gid, unix.AT_EMPTY_PATH)
+	}
+	if err != nil || !isDir {
+		unix.Close(fd)
+		if err != nil {
+			return &os.PathError{Op: "chown", Path: path, Err: err}
+		}
+		return nil
+	}
+	return chownDir(fd, path, uid, gid, false)
+}